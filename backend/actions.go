@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// An action callable through `POST /`, along with the types of its
+// parameters and result, from which its schemas and its part of the
+// OpenAPI document are generated.
+type Action struct {
+	Name    string
+	Summary string
+	Params  reflect.Type
+	Result  reflect.Type
+	// The schema of `Params`, and of a `POST /` request for this
+	// action, which is `Params` plus the `action` field
+	ParamsSchema  *Schema
+	RequestSchema *Schema
+
+	call func(ctx context.Context, body []byte) (any, error)
+}
+
+func NewAction[P any, R any](name string, summary string, handle func(ctx context.Context, p P) (R, error)) Action {
+	params := SchemaOf(reflect.TypeFor[P](), false)
+	request := params.Clone()
+	request.name = actionTypeName(name) + "Request"
+	request.Properties["action"] = &Schema{
+		Type: "string",
+		Enum: []any{name},
+	}
+	request.Required = append([]string{"action"}, request.Required...)
+	return Action{
+		Name:          name,
+		Summary:       summary,
+		Params:        reflect.TypeFor[P](),
+		Result:        reflect.TypeFor[R](),
+		ParamsSchema:  params,
+		RequestSchema: request,
+		call: func(ctx context.Context, body []byte) (any, error) {
+			var p P
+			err := json.Unmarshal(body, &p)
+			if err != nil {
+				return nil, err
+			}
+			return handle(ctx, p)
+		},
+	}
+}
+
+// Adapts a handler that doesn't need a context
+func withoutContext[P any, R any](handle func(p P) (R, error)) func(ctx context.Context, p P) (R, error) {
+	return func(_ context.Context, p P) (R, error) {
+		return handle(p)
+	}
+}
+
+// Returns the action called `name`, or nil if there's none
+func FindAction(name string) *Action {
+	for i := range ACTIONS {
+		if ACTIONS[i].Name == name {
+			return &ACTIONS[i]
+		}
+	}
+	return nil
+}
+
+// Validates `request` (as returned by `DecodeRequest`) against
+// `schema`, then calls the action with it
+func (a *Action) Call(ctx context.Context, request any, schema *Schema) (any, error) {
+	err := schema.Validate(request)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return a.call(ctx, body)
+}
+
+// Decodes a JSON request body, keeping numbers as `json.Number`
+// so that they can be validated exactly
+func DecodeRequest(body []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var request any
+	err := dec.Decode(&request)
+	if err == io.EOF {
+		return nil, NewError(CODE_INVALID_REQUEST, "invalid request: empty body")
+	}
+	if err != nil {
+		return nil, Errorf(CODE_INVALID_REQUEST, "invalid request: %v", err)
+	}
+	if dec.More() {
+		return nil, NewError(CODE_INVALID_REQUEST, "invalid request: unexpected data after the JSON value")
+	}
+	return request, nil
+}
+
+// Converts an action name like `api_key_create` to `ApiKeyCreate`
+func actionTypeName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
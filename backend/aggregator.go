@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mr-tron/base58"
+)
+
+type DepositInfo struct {
+	Signature string `json:"signature"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+type WithdrawInfo struct {
+	Signature string `json:"signature"`
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// The Ivy aggregator, which watches the chain for deposits to
+// and withdrawals from our game.
+type Aggregator interface {
+	// Fetches the deposit info. `*DepositInfo` will be nil on success if no deposit exists
+	Deposit(ctx context.Context, game [32]byte, id [32]byte) (*DepositInfo, error)
+	// Fetches the withdrawal info. `*WithdrawInfo` will be nil on success if the withdrawal hasn't been claimed
+	Withdrawal(ctx context.Context, game [32]byte, id [32]byte) (*WithdrawInfo, error)
+	// Returns an error if the aggregator is unreachable or unhealthy
+	Health(ctx context.Context) error
+}
+
+// Talks to an aggregator over HTTP
+type HTTPAggregator struct {
+	Url    string
+	Client *http.Client
+}
+
+// Creates an HTTP aggregator client, where every request times out after `timeout`
+func NewHTTPAggregator(url string, timeout time.Duration) *HTTPAggregator {
+	return &HTTPAggregator{
+		Url:    url,
+		Client: &http.Client{Timeout: timeout},
+	}
+}
+
+// An error reported by the aggregator itself, as opposed to a failure to
+// reach it. Asking again won't change the answer, so these aren't retried.
+type AggregatorError struct {
+	Msg string
+}
+
+func (e *AggregatorError) Error() string {
+	return e.Msg
+}
+
+// Every aggregator response is either {"status":"ok","data":...} or {"status":"err","msg":...}
+type aggregatorResponse[T any] struct {
+	Status string `json:"status"`
+	Msg    string `json:"msg"`
+	Data   *T     `json:"data"`
+}
+
+func aggregatorGet[T any](ctx context.Context, client *http.Client, url string) (*T, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var ar aggregatorResponse[T]
+	err = json.Unmarshal(bytes, &ar)
+	if err != nil {
+		return nil, fmt.Errorf("invalid aggregator response (HTTP %d): %v", resp.StatusCode, err)
+	}
+	if ar.Status == "err" {
+		return nil, &AggregatorError{Msg: ar.Msg}
+	}
+	if ar.Status != "ok" {
+		return nil, fmt.Errorf("invalid aggregator response status %q (HTTP %d)", ar.Status, resp.StatusCode)
+	}
+	return ar.Data, nil
+}
+
+func (a *HTTPAggregator) Deposit(ctx context.Context, game [32]byte, id [32]byte) (*DepositInfo, error) {
+	url := a.Url + "/games/" + base58.Encode(game[:]) + "/deposits/" + hex.EncodeToString(id[:])
+	return aggregatorGet[DepositInfo](ctx, a.Client, url)
+}
+
+func (a *HTTPAggregator) Withdrawal(ctx context.Context, game [32]byte, id [32]byte) (*WithdrawInfo, error) {
+	url := a.Url + "/games/" + base58.Encode(game[:]) + "/withdrawals/" + hex.EncodeToString(id[:])
+	return aggregatorGet[WithdrawInfo](ctx, a.Client, url)
+}
+
+func (a *HTTPAggregator) Health(ctx context.Context) error {
+	_, err := aggregatorGet[json.RawMessage](ctx, a.Client, a.Url+"/health")
+	return err
+}
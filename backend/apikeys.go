@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mr-tron/base58"
+)
+
+// API keys look like `API_KEY_PREFIX` followed by 32 random bytes in base58.
+// Only their SHA-256 hash is stored.
+const API_KEY_PREFIX = "dice_"
+
+var ErrApiKeyInvalid = NewError(CODE_AUTH_INVALID, "invalid API key")
+
+// Generate a new API key, returning the key and its hash
+func NewApiKey() (string, string) {
+	var secret [32]byte
+	_, err := io.ReadFull(rand.Reader, secret[:])
+	if err != nil {
+		panic(err)
+	}
+	key := API_KEY_PREFIX + base58.Encode(secret[:])
+	return key, HashApiKey(key)
+}
+
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns whether `scopes` grants `scope`
+func scopesAllow(scopes []string, scope Scope) bool {
+	switch scope {
+	case SCOPE_ACCOUNT:
+		return false
+	case SCOPE_READ:
+		return true
+	case SCOPE_WITHDRAW:
+		if !CONFIG.ApiKeyWithdrawEnabled {
+			return false
+		}
+	}
+	return slices.Contains(scopes, string(scope))
+}
+
+// Looks up an API key and checks that it may be used for `scope`
+func VerifyApiKey(key string, scope Scope) (ApiKey, error) {
+	if !strings.HasPrefix(key, API_KEY_PREFIX) {
+		return ApiKey{}, ErrApiKeyInvalid
+	}
+	k, err := DB.ApiKeyGetByHash(HashApiKey(key))
+	if err == sql.ErrNoRows {
+		return ApiKey{}, ErrApiKeyInvalid
+	}
+	if err != nil {
+		return ApiKey{}, err
+	}
+	if k.Revoked {
+		return ApiKey{}, NewError(CODE_AUTH_INVALID, "API key has been revoked")
+	}
+	if uint64(time.Now().Unix()) >= k.ExpiresAt {
+		return ApiKey{}, NewError(CODE_AUTH_EXPIRED, "API key has expired")
+	}
+	if !scopesAllow(k.Scopes, scope) {
+		if scope == SCOPE_ACCOUNT {
+			return ApiKey{}, NewError(CODE_FORBIDDEN, "this action can't be performed with an API key")
+		}
+		e := Errorf(CODE_FORBIDDEN, "API key is missing the %q scope", scope)
+		e.Details = map[string]any{"scope": scope}
+		return ApiKey{}, e
+	}
+	return k, nil
+}
+
+type ApiKeyCreateParams struct {
+	AuthData
+	Name             string   `json:"name" schema:"maxLength=64"`
+	Scopes           []string `json:"scopes" schema:"enum=read|bet|withdraw"`
+	MaxWagerCents    uint64   `json:"maxWagerCents"`    // optional: 0 means up to the game's max bet
+	ExpiresInSeconds uint64   `json:"expiresInSeconds"` // optional: defaults to `API_KEY_DEFAULT_TTL`
+}
+
+type ApiKeyCreateResult struct {
+	ApiKey
+	// The key itself. It can't be retrieved again, so store it now!
+	Key string `json:"key"`
+}
+
+// Creates an API key. This requires a wallet signature: a leaked session
+// token must not be enough to get a long-lived key.
+func onApiKeyCreate(p ApiKeyCreateParams) (ApiKeyCreateResult, error) {
+	// (1) Authenticate user
+	if p.Token != "" || p.ApiKey != "" {
+		return ApiKeyCreateResult{}, NewError(CODE_FORBIDDEN, "API keys can only be created with a signed auth message")
+	}
+	userId, err := Authenticate(p.AuthData, SCOPE_ACCOUNT)
+	if err != nil {
+		return ApiKeyCreateResult{}, err
+	}
+
+	// (2) Validate parameters
+	if len(p.Name) > 64 {
+		return ApiKeyCreateResult{}, NewError(CODE_INVALID_REQUEST, "API key name must be at most 64 characters")
+	}
+	scopes := []string{}
+	for _, s := range p.Scopes {
+		switch Scope(s) {
+		case SCOPE_READ, SCOPE_BET:
+		case SCOPE_WITHDRAW:
+			if !CONFIG.ApiKeyWithdrawEnabled {
+				return ApiKeyCreateResult{}, NewError(CODE_FORBIDDEN, "API keys with the withdraw scope are disabled")
+			}
+		default:
+			return ApiKeyCreateResult{}, Errorf(CODE_INVALID_REQUEST, "unknown API key scope %q", s)
+		}
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	ttl := API_KEY_DEFAULT_TTL
+	if p.ExpiresInSeconds > 0 {
+		ttl = time.Duration(p.ExpiresInSeconds) * time.Second
+		if p.ExpiresInSeconds > uint64(API_KEY_MAX_TTL.Seconds()) {
+			return ApiKeyCreateResult{}, Errorf(CODE_INVALID_REQUEST, "API keys may be valid for at most %s", API_KEY_MAX_TTL)
+		}
+	}
+
+	// (3) Create key
+	key, hash := NewApiKey()
+	now := time.Now()
+	k := ApiKey{
+		UserId:        userId,
+		Name:          p.Name,
+		Prefix:        key[:len(API_KEY_PREFIX)+6],
+		Scopes:        scopes,
+		MaxWagerCents: p.MaxWagerCents,
+		CreatedAt:     uint64(now.Unix()),
+		ExpiresAt:     uint64(now.Add(ttl).Unix()),
+	}
+	k.Id, err = DB.ApiKeyCreate(k, hash)
+	if err != nil {
+		return ApiKeyCreateResult{}, err
+	}
+	return ApiKeyCreateResult{
+		ApiKey: k,
+		Key:    key,
+	}, nil
+}
+
+type ApiKeyListParams struct {
+	AuthData
+}
+
+func onApiKeyList(p ApiKeyListParams) ([]ApiKey, error) {
+	userId, err := Authenticate(p.AuthData, SCOPE_ACCOUNT)
+	if err != nil {
+		return nil, err
+	}
+	return DB.ApiKeyList(userId)
+}
+
+type ApiKeyRevokeParams struct {
+	AuthData
+	Id uint64 `json:"id" schema:"required"`
+}
+
+func onApiKeyRevoke(p ApiKeyRevokeParams) (struct{}, error) {
+	userId, err := Authenticate(p.AuthData, SCOPE_ACCOUNT)
+	if err != nil {
+		return struct{}{}, err
+	}
+	err = DB.ApiKeyRevoke(userId, p.Id)
+	if err != nil {
+		return struct{}{}, err
+	}
+	FEED.Recheck(userId)
+	return struct{}{}, nil
+}
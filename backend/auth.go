@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58"
+)
+
+// How to authenticate a request: a signed auth message, a session
+// token obtained from `login`, or an API key from `api_key_create`
+type AuthData struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+	Token     string `json:"token"`
+	ApiKey    string `json:"apiKey"`
+}
+
+// What an action needs to be allowed to do. Wallet signatures and session
+// tokens can do anything; API keys only what they were created with.
+type Scope string
+
+const (
+	SCOPE_READ     Scope = "read"     // view the account; implied by every API key
+	SCOPE_BET      Scope = "bet"      // bet, rotate seeds and create deposits
+	SCOPE_WITHDRAW Scope = "withdraw" // withdraw funds; see `api_key_withdraw_enabled`
+	SCOPE_ACCOUNT  Scope = ""         // manage the account itself; never allowed for API keys
+)
+
+var ErrAuthRequired = NewError(CODE_AUTH_REQUIRED, "this action requires authentication")
+var ErrSessionInvalid = NewError(CODE_AUTH_INVALID, "invalid session token")
+var ErrSessionExpired = NewError(CODE_AUTH_EXPIRED, "session expired: please log in again")
+var ErrAuthRevoked = NewError(CODE_AUTH_EXPIRED, "auth message was revoked: please sign a new one")
+
+// Authenticates a request for an action needing `scope`,
+// returning the base58 address of the user
+func Authenticate(a AuthData, scope Scope) (string, error) {
+	userId, _, err := AuthenticateWithKey(a, scope)
+	return userId, err
+}
+
+// Just like Authenticate, but also returns the API key
+// used, or nil if the request wasn't made with one
+func AuthenticateWithKey(a AuthData, scope Scope) (string, *ApiKey, error) {
+	if a.ApiKey != "" {
+		key, err := VerifyApiKey(a.ApiKey, scope)
+		if err != nil {
+			return "", nil, err
+		}
+		return key.UserId, &key, nil
+	}
+	userId, _, err := authenticateUser(a)
+	return userId, nil, err
+}
+
+// Just like Authenticate, but also returns when the credentials expire,
+// for callers that keep relying on them (e.g. the live feed)
+func AuthenticateUntil(a AuthData, scope Scope) (string, uint64, error) {
+	if a.ApiKey != "" {
+		key, err := VerifyApiKey(a.ApiKey, scope)
+		if err != nil {
+			return "", 0, err
+		}
+		return key.UserId, key.ExpiresAt, nil
+	}
+	return authenticateUser(a)
+}
+
+// Authenticates a request made with a wallet signature or session
+// token, returning the user and when the credentials expire
+func authenticateUser(a AuthData) (string, uint64, error) {
+	if a.Token != "" {
+		s, err := SESSIONS.Verify(a.Token)
+		if err != nil {
+			return "", 0, err
+		}
+		return s.UserId, s.ExpiresAt, nil
+	}
+	if a.Message == "" && a.Signature == "" {
+		return "", 0, ErrAuthRequired
+	}
+	am, err := authenticateMessage(a.Message, a.Signature)
+	if err != nil {
+		return "", 0, err
+	}
+	// `To` is the last second the message covers
+	return base58.Encode(am.User[:]), am.To + 1, nil
+}
+
+// Verifies a signed auth message, rejecting messages that were
+// signed before the user last called `revoke_sessions`
+func authenticateMessage(message string, signature string) (AuthMessage, error) {
+	am, err := VerifyAuthMessage(GAME_ADDRESS, message, signature)
+	if err != nil {
+		return AuthMessage{}, err
+	}
+	if am.From < SESSIONS.NotBefore(base58.Encode(am.User[:])) {
+		return AuthMessage{}, ErrAuthRevoked
+	}
+	return am, nil
+}
+
+type Session struct {
+	Id        string `json:"id"`
+	UserId    string `json:"userId"`
+	IssuedAt  uint64 `json:"issuedAt"`
+	ExpiresAt uint64 `json:"expiresAt"`
+}
+
+// Issues and verifies session tokens.
+//
+// A token is `base64(payload) + "." + base64(HMAC-SHA256(key, payload))`,
+// where the payload is `id:userId:issuedAt:expiresAt`. Tokens are checked
+// without touching the database; the only state is the set of tokens that
+// were revoked before they expired, and the time each user last revoked
+// all of their sessions, both of which are persisted so that they survive
+// restarts.
+type Sessions struct {
+	key []byte
+
+	mu        sync.Mutex
+	revoked   map[string]uint64 // session ID -> expiry
+	notBefore map[string]uint64 // user ID -> time of last `revoke_sessions`
+}
+
+// Creates a session manager that signs tokens with `key`, loading
+// previously revoked sessions from the database
+func NewSessions(key []byte) (*Sessions, error) {
+	now := uint64(time.Now().Unix())
+	revoked, err := DB.SessionListRevoked(now)
+	if err != nil {
+		return nil, err
+	}
+	notBefore, err := DB.UserListAuthNotBefore()
+	if err != nil {
+		return nil, err
+	}
+	return &Sessions{
+		key:       key,
+		revoked:   revoked,
+		notBefore: notBefore,
+	}, nil
+}
+
+// Generate a random 32-byte session key
+func NewSessionKey() []byte {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func (s *Sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issues a token for `userId`, valid until `expiresAt`
+func (s *Sessions) Issue(userId string, expiresAt uint64) (string, Session) {
+	var id [16]byte
+	_, err := io.ReadFull(rand.Reader, id[:])
+	if err != nil {
+		panic(err)
+	}
+	session := Session{
+		Id:        hex.EncodeToString(id[:]),
+		UserId:    userId,
+		IssuedAt:  uint64(time.Now().Unix()),
+		ExpiresAt: expiresAt,
+	}
+	payload := session.Id + ":" + session.UserId + ":" +
+		strconv.FormatUint(session.IssuedAt, 10) + ":" + strconv.FormatUint(session.ExpiresAt, 10)
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + s.sign(payload)
+	return token, session
+}
+
+// Verifies a token, returning its session
+func (s *Sessions) Verify(token string) (Session, error) {
+	// (1) Check the signature
+	encoded, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return Session{}, ErrSessionInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Session{}, ErrSessionInvalid
+	}
+	if !hmac.Equal([]byte(mac), []byte(s.sign(string(payload)))) {
+		return Session{}, ErrSessionInvalid
+	}
+
+	// (2) Parse the payload
+	parts := strings.Split(string(payload), ":")
+	if len(parts) != 4 {
+		return Session{}, ErrSessionInvalid
+	}
+	issuedAt, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return Session{}, ErrSessionInvalid
+	}
+	expiresAt, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		return Session{}, ErrSessionInvalid
+	}
+	session := Session{
+		Id:        parts[0],
+		UserId:    parts[1],
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiresAt,
+	}
+
+	// (3) Check it's still valid
+	if uint64(time.Now().Unix()) >= session.ExpiresAt {
+		return Session{}, ErrSessionExpired
+	}
+	s.mu.Lock()
+	_, revoked := s.revoked[session.Id]
+	notBefore, revokedAll := s.notBefore[session.UserId]
+	s.mu.Unlock()
+	// like auth messages, a token issued in the same second as
+	// `revoke_sessions` is accepted, so logging in again works at once
+	if revoked || (revokedAll && session.IssuedAt < notBefore) {
+		return Session{}, ErrSessionExpired
+	}
+	return session, nil
+}
+
+// Returns the earliest `from` we'll accept in `userId`'s auth messages
+func (s *Sessions) NotBefore(userId string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.notBefore[userId]
+}
+
+// Revokes all of `userId`'s sessions, signed auth messages and API keys,
+// returning the time from which new ones will be accepted
+func (s *Sessions) RevokeAll(userId string) (uint64, error) {
+	now := uint64(time.Now().Unix())
+	err := DB.WithTx(func(tx *Tx) error {
+		// make sure the user exists, so the revocation sticks
+		_, err := tx.UserGet(userId)
+		if err != nil {
+			return err
+		}
+		err = tx.UserSetAuthNotBefore(userId, now)
+		if err != nil {
+			return err
+		}
+		// like sessions, keys created in the same second are kept
+		return tx.ApiKeyRevokeAll(userId, now)
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	s.notBefore[userId] = now
+	s.mu.Unlock()
+	return now, nil
+}
+
+// Revokes a session before it expires
+func (s *Sessions) Revoke(session Session) error {
+	err := DB.SessionRevoke(session.Id, session.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.revoked[session.Id] = session.ExpiresAt
+	s.mu.Unlock()
+	return nil
+}
+
+// Forgets revoked sessions that have expired anyway
+func (s *Sessions) Prune() {
+	now := uint64(time.Now().Unix())
+	err := DB.SessionPruneRevoked(now)
+	if err != nil {
+		log.Printf("Can't prune revoked sessions: %v", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, expiresAt := range s.revoked {
+		if now >= expiresAt {
+			delete(s.revoked, id)
+		}
+	}
+}
+
+type LoginParams struct {
+	Message   string `json:"message" schema:"required"`
+	Signature string `json:"signature" schema:"required"`
+}
+
+type LoginResult struct {
+	Token     string `json:"token"`
+	UserId    string `json:"userId"`
+	ExpiresAt uint64 `json:"expiresAt"`
+}
+
+// Exchanges a signed auth message for a short-lived session token,
+// which expires no later than the message itself
+func onLogin(p LoginParams) (LoginResult, error) {
+	am, err := authenticateMessage(p.Message, p.Signature)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	userId := base58.Encode(am.User[:])
+	expiresAt := uint64(time.Now().Add(SESSION_TTL).Unix())
+	if am.To < expiresAt {
+		expiresAt = am.To
+	}
+	token, session := SESSIONS.Issue(userId, expiresAt)
+	return LoginResult{
+		Token:     token,
+		UserId:    userId,
+		ExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+type LogoutParams struct {
+	Token string `json:"token" schema:"required"`
+}
+
+// Revokes the given session token
+func onLogout(p LogoutParams) (struct{}, error) {
+	if p.Token == "" {
+		return struct{}{}, NewError(CODE_INVALID_REQUEST, "logout requires a session token")
+	}
+	session, err := SESSIONS.Verify(p.Token)
+	if errors.Is(err, ErrSessionExpired) {
+		// already logged out
+		return struct{}{}, nil
+	}
+	if err != nil {
+		return struct{}{}, err
+	}
+	err = SESSIONS.Revoke(session)
+	if err != nil {
+		return struct{}{}, err
+	}
+	FEED.Recheck(session.UserId)
+	return struct{}{}, nil
+}
+
+type RevokeSessionsParams struct {
+	AuthData
+}
+
+type RevokeSessionsResult struct {
+	// Auth messages must be valid from this time or later
+	NotBefore uint64 `json:"notBefore"`
+}
+
+// Invalidates all of the user's session tokens, previously signed auth
+// messages and API keys, e.g. if a cookie leaked
+func onRevokeSessions(p RevokeSessionsParams) (RevokeSessionsResult, error) {
+	userId, err := Authenticate(p.AuthData, SCOPE_ACCOUNT)
+	if err != nil {
+		return RevokeSessionsResult{}, err
+	}
+	notBefore, err := SESSIONS.RevokeAll(userId)
+	if err != nil {
+		return RevokeSessionsResult{}, err
+	}
+	FEED.Recheck(userId)
+	return RevokeSessionsResult{
+		NotBefore: notBefore,
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivypowered/ivy-dice/backend/client"
+)
+
+func TestRevokeSessionsAllowsLoggingInAgain(t *testing.T) {
+	b := startTestBackend(t)
+	b.balance(t) // creates the user
+
+	b.mustCall(t, "revoke_sessions", nil, &RevokeSessionsResult{})
+	// both are likely in the same second as the revocation
+	var login LoginResult
+	b.mustCall(t, "login", nil, &login)
+	var key ApiKeyCreateResult
+	b.mustCall(t, "api_key_create", map[string]any{"scopes": []string{"read"}}, &key)
+
+	var user UserClient
+	err := callAnonymous("user_get", map[string]any{"token": login.Token}, &user)
+	if err != nil {
+		t.Fatalf("token issued after revoke_sessions: %v", err)
+	}
+	err = callAnonymous("user_get", map[string]any{"apiKey": key.Key}, &user)
+	if err != nil {
+		t.Fatalf("API key created after revoke_sessions: %v", err)
+	}
+}
+
+func TestSessionsRevokedBeforeNotBefore(t *testing.T) {
+	b := startTestBackend(t)
+	token, session := SESSIONS.Issue(b.user, uint64(time.Now().Add(time.Hour).Unix()))
+
+	SESSIONS.mu.Lock()
+	SESSIONS.notBefore[b.user] = session.IssuedAt
+	SESSIONS.mu.Unlock()
+	_, err := SESSIONS.Verify(token)
+	if err != nil {
+		t.Fatalf("token issued at notBefore was rejected: %v", err)
+	}
+
+	SESSIONS.mu.Lock()
+	SESSIONS.notBefore[b.user] = session.IssuedAt + 1
+	SESSIONS.mu.Unlock()
+	_, err = SESSIONS.Verify(token)
+	if !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("token issued before notBefore: expected it to be expired, got %v", err)
+	}
+}
+
+func TestVerifyAuthMessageRejectsBadValidity(t *testing.T) {
+	b := startTestBackend(t)
+	public := b.key.Public().(ed25519.PublicKey)
+	now := uint64(time.Now().Unix())
+	tests := []struct {
+		from, to uint64
+		reason   string
+	}{
+		{now, now - 1, "ends before it starts"},
+		{now, now + uint64(AUTH_MESSAGE_MAX_VALIDITY.Seconds()) + 1, "validity too long"},
+	}
+	for _, tt := range tests {
+		message := client.AuthMessage(public, GAME_ADDRESS, tt.from, tt.to)
+		_, err := VerifyAuthMessage(GAME_ADDRESS, message, client.SignAuthMessage(b.key, message))
+		assertCode(t, err, CODE_AUTH_INVALID)
+		if !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("from %d to %d: expected %q, got %v", tt.from, tt.to, tt.reason, err)
+		}
+	}
+}
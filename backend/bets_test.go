@@ -0,0 +1,218 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ivypowered/ivy-dice/backend/dice"
+)
+
+func TestVerifyBetReproducesBet(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 100_000)
+
+	var bets []BetResult
+	for range 10 {
+		var bet BetResult
+		b.mustCall(t, "bet", map[string]any{"wagerCents": 1234, "rollUnder": true, "threshold": 5000}, &bet)
+		bets = append(bets, bet)
+	}
+	var rotation RotateSeedResult
+	b.mustCall(t, "rotate_seed", nil, &rotation)
+
+	for _, bet := range bets {
+		var verified VerifyBetResult
+		err := callAnonymous("verify_bet", map[string]any{
+			"serverSeed":       rotation.ServerSeed,
+			"clientSeed":       bet.ClientSeed,
+			"nonce":            bet.Nonce,
+			"rollUnder":        true,
+			"threshold":        5000,
+			"wagerCents":       1234,
+			"algorithmVersion": bet.AlgorithmVersion,
+			"houseEdgePct":     bet.HouseEdgePct,
+		}, &verified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verified.ServerSeedHash != bet.ServerSeedHash {
+			t.Fatalf("bet %d: revealed seed hashes to %s, but the bet was made under %s", bet.Nonce, verified.ServerSeedHash, bet.ServerSeedHash)
+		}
+		if verified.Result != bet.Result || verified.Won != bet.Won || verified.DeltaCents != bet.DeltaCents {
+			t.Fatalf("bet %d: verified as %+v, but settled as %+v", bet.Nonce, verified, bet)
+		}
+		if int64(verified.PayoutCents) != 1234+bet.DeltaCents {
+			t.Fatalf("bet %d: verified payout %d doesn't match delta %d", bet.Nonce, verified.PayoutCents, bet.DeltaCents)
+		}
+	}
+}
+
+func TestVerifyBetRejectsOverflowingWager(t *testing.T) {
+	startTestBackend(t)
+	params := map[string]any{
+		"serverSeed": "0000000000000000000000000000000000000000000000000000000000000000",
+		"clientSeed": "client",
+		"nonce":      0,
+		"rollUnder":  true,
+		"threshold":  9000,
+		"wagerCents": uint64(MAX_WAGER_CENTS),
+	}
+	err := callAnonymous("verify_bet", params, &VerifyBetResult{})
+	if err != nil {
+		t.Fatalf("the largest wager should be accepted: %v", err)
+	}
+	params["wagerCents"] = uint64(MAX_WAGER_CENTS) + 1
+	err = callAnonymous("verify_bet", params, &VerifyBetResult{})
+	assertCode(t, err, CODE_INVALID_REQUEST)
+}
+
+// Clients from before seed rotation send a `clientSeed` with each bet
+func TestBetIgnoresRemovedClientSeed(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 1000)
+
+	var bet BetResult
+	b.mustCall(t, "bet", map[string]any{"wagerCents": 100, "rollUnder": true, "threshold": 5000, "clientSeed": "0123456789abcdef"}, &bet)
+	if bet.ClientSeed == "0123456789abcdef" {
+		t.Fatal("bet used the client seed it was sent, instead of the seed pair's")
+	}
+}
+
+// Returns a bet of `wagerCents` that wins or loses, as `win` says, when
+// rolled on `nonce` of `sp`, along with how it settles
+func riggedBet(t *testing.T, sp SeedPair, nonce uint64, wagerCents uint64, win bool) (map[string]any, dice.Outcome) {
+	t.Helper()
+	roll, err := dice.Roll(dice.AlgorithmLatest, sp.ServerSeed, sp.ClientSeed, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// under 5000 and over 4999 split the rolls in half
+	rollUnder := (roll < 5000) == win
+	threshold := uint16(5000)
+	if !rollUnder {
+		threshold = 4999
+	}
+	outcome := dice.Settle(wagerCents, rollUnder, threshold, roll, CurrentGameParams().HouseEdgePct)
+	if outcome.Won != win {
+		t.Fatalf("rigged bet on nonce %d doesn't settle as won=%t", nonce, win)
+	}
+	return map[string]any{"wagerCents": wagerCents, "rollUnder": rollUnder, "threshold": threshold}, outcome
+}
+
+// Places `bet_batch` with rigged bets winning or losing as `wins` says,
+// checking that the bets it placed used consecutive nonces of the
+// active seed pair, and that the pair's nonce moved past them
+func (b *testBackend) riggedBatch(t *testing.T, wagerCents uint64, wins []bool, params map[string]any) (BetBatchResult, []dice.Outcome) {
+	t.Helper()
+	sp, err := DB.SeedPairGetActive(b.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bets []map[string]any
+	var outcomes []dice.Outcome
+	for i, win := range wins {
+		bet, outcome := riggedBet(t, sp, sp.Nonce+uint64(i), wagerCents, win)
+		bets = append(bets, bet)
+		outcomes = append(outcomes, outcome)
+	}
+	request := map[string]any{"bets": bets}
+	for k, v := range params {
+		request[k] = v
+	}
+	var result BetBatchResult
+	b.mustCall(t, "bet_batch", request, &result)
+
+	for i, r := range result.Results {
+		if r.Nonce != sp.Nonce+uint64(i) || r.SeedPairId != sp.Id {
+			t.Fatalf("bet %d was placed on pair %d nonce %d, expected pair %d nonce %d", i, r.SeedPairId, r.Nonce, sp.Id, sp.Nonce+uint64(i))
+		}
+		if r.DeltaCents != outcomes[i].DeltaCents {
+			t.Fatalf("bet %d: delta %d, expected %d", i, r.DeltaCents, outcomes[i].DeltaCents)
+		}
+	}
+	var user UserClient
+	b.mustCall(t, "user_get", nil, &user)
+	if user.Nonce != sp.Nonce+uint64(len(result.Results)) {
+		t.Fatalf("nonce is %d after %d bets from %d", user.Nonce, len(result.Results), sp.Nonce)
+	}
+	return result, outcomes
+}
+
+func TestBetBatchPlacesEveryBet(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 1000)
+
+	result, outcomes := b.riggedBatch(t, 100, []bool{true, false, true}, nil)
+	if len(result.Results) != 3 || result.StoppedBy != "" {
+		t.Fatalf("placed %d bets, stopped by %q", len(result.Results), result.StoppedBy)
+	}
+	delta := outcomes[0].DeltaCents + outcomes[1].DeltaCents + outcomes[2].DeltaCents
+	if result.DeltaCents != delta || result.BalanceCents != uint64(1000+delta) {
+		t.Fatalf("delta %d and balance %d, expected %d and %d", result.DeltaCents, result.BalanceCents, delta, 1000+delta)
+	}
+	if balance := b.balance(t); balance != result.BalanceCents {
+		t.Fatalf("balance is %d, but the batch reported %d", balance, result.BalanceCents)
+	}
+
+	// the next batch carries on from the nonce this one stopped at
+	b.riggedBatch(t, 100, []bool{false, true}, nil)
+}
+
+func TestBetBatchStopLoss(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 1000)
+
+	result, _ := b.riggedBatch(t, 100, []bool{false, false, true, true}, map[string]any{"stopLossCents": 200})
+	if len(result.Results) != 2 || result.StoppedBy != BET_BATCH_STOP_LOSS {
+		t.Fatalf("placed %d bets, stopped by %q", len(result.Results), result.StoppedBy)
+	}
+	if result.DeltaCents != -200 || result.BalanceCents != 800 {
+		t.Fatalf("delta %d and balance %d, expected -200 and 800", result.DeltaCents, result.BalanceCents)
+	}
+	if balance := b.balance(t); balance != 800 {
+		t.Fatalf("balance is %d, expected 800", balance)
+	}
+}
+
+func TestBetBatchTakeProfit(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 1000)
+
+	// one win is enough
+	sp, err := DB.SeedPairGetActive(b.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, win := riggedBet(t, sp, sp.Nonce, 100, true)
+	result, _ := b.riggedBatch(t, 100, []bool{true, false, false}, map[string]any{"takeProfitCents": win.DeltaCents})
+	if len(result.Results) != 1 || result.StoppedBy != BET_BATCH_TAKE_PROFIT {
+		t.Fatalf("placed %d bets, stopped by %q", len(result.Results), result.StoppedBy)
+	}
+	if result.DeltaCents != win.DeltaCents || result.BalanceCents != uint64(1000+win.DeltaCents) {
+		t.Fatalf("delta %d and balance %d, expected %d and %d", result.DeltaCents, result.BalanceCents, win.DeltaCents, 1000+win.DeltaCents)
+	}
+}
+
+func TestBetBatchInsufficientBalance(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 150)
+
+	result, _ := b.riggedBatch(t, 100, []bool{false, true}, nil)
+	if len(result.Results) != 1 || result.StoppedBy != BET_BATCH_INSUFFICIENT_BALANCE {
+		t.Fatalf("placed %d bets, stopped by %q", len(result.Results), result.StoppedBy)
+	}
+	if result.DeltaCents != -100 || result.BalanceCents != 50 {
+		t.Fatalf("delta %d and balance %d, expected -100 and 50", result.DeltaCents, result.BalanceCents)
+	}
+
+	// not even the first bet can be placed now, so the batch fails
+	// without using a nonce
+	var user UserClient
+	b.mustCall(t, "user_get", nil, &user)
+	err := b.call("bet_batch", map[string]any{"bets": []map[string]any{{"wagerCents": 100, "rollUnder": true, "threshold": 5000}}}, &BetBatchResult{})
+	assertCode(t, err, CODE_INSUFFICIENT_BALANCE)
+	var after UserClient
+	b.mustCall(t, "user_get", nil, &after)
+	if after.Nonce != user.Nonce || after.BalanceCents != 50 {
+		t.Fatalf("failed batch moved the nonce from %d to %d, and the balance to %d", user.Nonce, after.Nonce, after.BalanceCents)
+	}
+}
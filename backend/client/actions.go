@@ -0,0 +1,255 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Checks that the backend is up
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, "ping", nil, false, nil)
+}
+
+// Returns the maximum wager, in cents
+func (c *Client) MaxBet(ctx context.Context) (uint64, error) {
+	var r struct {
+		MaxBetCents uint64 `json:"maxBetCents"`
+	}
+	err := c.call(ctx, "max_bet", nil, false, &r)
+	return r.MaxBetCents, err
+}
+
+// Exchanges a signed auth message for a session token, which
+// the client then uses instead of signed messages until it expires
+func (c *Client) Login(ctx context.Context) (LoginResult, error) {
+	c.mu.Lock()
+	message := c.signedMessage()
+	c.mu.Unlock()
+	var r LoginResult
+	err := c.call(ctx, "login", message, false, &r)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	c.mu.Lock()
+	c.token = r.Token
+	c.tokenExp = time.Unix(int64(r.ExpiresAt), 0)
+	c.mu.Unlock()
+	return r, nil
+}
+
+// Revokes the session token from `Login`, if any. The client goes back
+// to signing auth messages.
+func (c *Client) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	token := c.token
+	c.token = ""
+	c.mu.Unlock()
+	if token == "" {
+		return nil
+	}
+	return c.call(ctx, "logout", map[string]string{"token": token}, false, nil)
+}
+
+// Revokes all of the user's session tokens, signed auth messages and API
+// keys, including this client's, which signs a fresh message from then on.
+// Returns the time that auth messages must now be valid from.
+func (c *Client) RevokeSessions(ctx context.Context) (uint64, error) {
+	var r struct {
+		NotBefore uint64 `json:"notBefore"`
+	}
+	err := c.call(ctx, "revoke_sessions", nil, true, &r)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.token = ""
+	c.message = ""
+	c.notBefore = r.NotBefore
+	c.mu.Unlock()
+	return r.NotBefore, nil
+}
+
+// Creates an API key. This is always authenticated with a signed auth
+// message, even after `Login`, as the backend requires one.
+func (c *Client) ApiKeyCreate(ctx context.Context, p ApiKeyCreateParams) (ApiKeyCreateResult, error) {
+	c.mu.Lock()
+	message := c.signedMessage()
+	c.mu.Unlock()
+	params := struct {
+		ApiKeyCreateParams
+		Message   any `json:"message"`
+		Signature any `json:"signature"`
+	}{p, message["message"], message["signature"]}
+	var r ApiKeyCreateResult
+	err := c.call(ctx, "api_key_create", params, false, &r)
+	return r, err
+}
+
+func (c *Client) ApiKeyList(ctx context.Context) ([]ApiKey, error) {
+	var r []ApiKey
+	err := c.call(ctx, "api_key_list", nil, true, &r)
+	return r, err
+}
+
+func (c *Client) ApiKeyRevoke(ctx context.Context, id uint64) error {
+	return c.call(ctx, "api_key_revoke", map[string]uint64{"id": id}, true, nil)
+}
+
+// Returns the game parameters currently in effect
+func (c *Client) GameParams(ctx context.Context) (GameParams, error) {
+	var r GameParams
+	err := c.call(ctx, "game_params", nil, false, &r)
+	return r, err
+}
+
+// Changes the game parameters (admins only). `changes` holds the
+// fields of `GameParams` to change, e.g. map[string]any{"houseEdgePct": 2}.
+func (c *Client) SetGameParams(ctx context.Context, changes map[string]any) (GameParams, error) {
+	var r GameParams
+	err := c.call(ctx, "set_game_params", map[string]any{"params": changes}, true, &r)
+	return r, err
+}
+
+// Returns the user, including the hash of their active server seed,
+// which is recorded as a commitment
+func (c *Client) UserGet(ctx context.Context) (User, error) {
+	var r User
+	err := c.call(ctx, "user_get", nil, true, &r)
+	if err != nil {
+		return User{}, err
+	}
+	c.commitUser(r)
+	return r, nil
+}
+
+// Places a bet. The server seed hash it was made under is recorded,
+// so that the seed can be checked once it's revealed.
+func (c *Client) Bet(ctx context.Context, p BetParams) (BetResult, error) {
+	var r BetResult
+	err := c.call(ctx, "bet", p, true, &r)
+	if err != nil {
+		return BetResult{}, err
+	}
+	c.commitBet(r)
+	return r, nil
+}
+
+// Places several bets in a row, in one transaction, stopping early if
+// the stop-loss or take-profit in `p` is reached. Like `Bet`, records
+// the server seed hash the bets were made under.
+func (c *Client) BetBatch(ctx context.Context, p BetBatchParams) (BetBatchResult, error) {
+	var r BetBatchResult
+	err := c.call(ctx, "bet_batch", p, true, &r)
+	if err != nil {
+		return BetBatchResult{}, err
+	}
+	for _, bet := range r.Results {
+		c.commitBet(bet)
+	}
+	return r, nil
+}
+
+// Has the backend recompute a bet from its seeds. To check a bet without
+// trusting the backend, use the `dice` package instead.
+func (c *Client) VerifyBet(ctx context.Context, p VerifyBetParams) (VerifyBetResult, error) {
+	var r VerifyBetResult
+	err := c.call(ctx, "verify_bet", p, false, &r)
+	return r, err
+}
+
+// Reveals the active seed pair and starts a new one, with `clientSeed`
+// or, if empty, the current client seed. Fails with `ErrVerificationFailed`
+// if the revealed server seed isn't the one that was committed to.
+func (c *Client) RotateSeed(ctx context.Context, clientSeed string) (RotateSeedResult, error) {
+	var r RotateSeedResult
+	err := c.call(ctx, "rotate_seed", map[string]string{"clientSeed": clientSeed}, true, &r)
+	if err != nil {
+		return RotateSeedResult{}, err
+	}
+	err = c.verifyRotation(r)
+	if err != nil {
+		return RotateSeedResult{}, err
+	}
+	return r, nil
+}
+
+// Creates a deposit, which the user pays at the returned URL
+func (c *Client) Deposit(ctx context.Context, amountCents uint64) (DepositResult, error) {
+	var r DepositResult
+	err := c.call(ctx, "deposit", map[string]uint64{"amountCents": amountCents}, true, &r)
+	return r, err
+}
+
+// Creates a withdrawal, which the user claims at the returned URL
+func (c *Client) Withdraw(ctx context.Context, amountCents uint64) (WithdrawResult, error) {
+	var r WithdrawResult
+	err := c.call(ctx, "withdraw", map[string]uint64{"amountCents": amountCents}, true, &r)
+	return r, err
+}
+
+func (c *Client) DepositStatus(ctx context.Context, id string) (Deposit, error) {
+	var r Deposit
+	err := c.call(ctx, "deposit_status", map[string]string{"depositId": id}, true, &r)
+	return r, err
+}
+
+func (c *Client) WithdrawStatus(ctx context.Context, id string) (Withdrawal, error) {
+	var r Withdrawal
+	err := c.call(ctx, "withdraw_status", map[string]string{"withdrawId": id}, true, &r)
+	return r, err
+}
+
+type listParams struct {
+	Count int `json:"count"`
+	Skip  int `json:"skip"`
+}
+
+// Lists bets, newest first, verifying those whose seeds have been revealed
+// (see `Bet.Committed`)
+func (c *Client) BetList(ctx context.Context, count int, skip int) ([]Bet, error) {
+	var r []Bet
+	err := c.call(ctx, "bet_list", listParams{count, skip}, true, &r)
+	if err != nil {
+		return nil, err
+	}
+	err = c.verifyBets(r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Lists bets a page at a time, newest first, verifying those whose seeds
+// have been revealed. `cursor` is the previous page's `NextCursor`, or
+// empty for the first page.
+func (c *Client) BetPage(ctx context.Context, count int, cursor string) (BetPage, error) {
+	var r BetPage
+	err := c.call(ctx, "bet_page", map[string]any{"count": count, "cursor": cursor}, true, &r)
+	if err != nil {
+		return BetPage{}, err
+	}
+	err = c.verifyBets(r.Bets)
+	if err != nil {
+		return BetPage{}, err
+	}
+	return r, nil
+}
+
+func (c *Client) DepositList(ctx context.Context, count int, skip int) ([]Deposit, error) {
+	var r []Deposit
+	err := c.call(ctx, "deposit_list", listParams{count, skip}, true, &r)
+	return r, err
+}
+
+func (c *Client) WithdrawList(ctx context.Context, count int, skip int) ([]Withdrawal, error) {
+	var r []Withdrawal
+	err := c.call(ctx, "withdraw_list", listParams{count, skip}, true, &r)
+	return r, err
+}
+
+// Lists balance movements, newest first
+func (c *Client) BalanceHistory(ctx context.Context, count int, skip int) ([]LedgerEntry, error) {
+	var r []LedgerEntry
+	err := c.call(ctx, "balance_history", listParams{count, skip}, true, &r)
+	return r, err
+}
@@ -0,0 +1,243 @@
+// Package client is a Go client for the dice backend.
+//
+// It authenticates by signing the same message as the frontend, calls
+// actions through `POST /`, and checks every server seed the backend
+// reveals against the hash it committed to beforehand, failing with
+// `ErrVerificationFailed` if they don't match.
+//
+//	c := client.New("https://dice.example.com", game, privateKey)
+//	result, err := c.Bet(ctx, client.BetParams{WagerCents: 100, RollUnder: true, Threshold: 4950})
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58"
+)
+
+// The message users sign to authenticate, as matched by the
+// backend's `VERIFY_MESSAGE_REGEX`
+const AUTH_MESSAGE_FORMAT = "Authenticate user %s to game %s on ivypowered.com, valid from %d to %d"
+
+// How long each signed auth message is valid for. The backend
+// accepts at most 7 days.
+const AUTH_MESSAGE_VALIDITY = 1 * time.Hour
+
+// Sign a new auth message once the current one has less than this left
+const AUTH_MESSAGE_RENEW_BEFORE = 5 * time.Minute
+
+// How long to wait for a response from the backend
+const DEFAULT_TIMEOUT = 30 * time.Second
+
+// Builds the auth message for `user` playing `game`, valid from `from` to `to`
+func AuthMessage(user ed25519.PublicKey, game [32]byte, from uint64, to uint64) string {
+	return fmt.Sprintf(AUTH_MESSAGE_FORMAT, base58.Encode(user), base58.Encode(game[:]), from, to)
+}
+
+// Signs an auth message, returning the hex-encoded signature the backend expects
+func SignAuthMessage(key ed25519.PrivateKey, message string) string {
+	return hex.EncodeToString(ed25519.Sign(key, []byte(message)))
+}
+
+// A client for one user of one game. It's safe for concurrent use.
+type Client struct {
+	url  string
+	game [32]byte
+	key  ed25519.PrivateKey
+	// The HTTP client used for requests, which may be replaced
+	// before the first request is made
+	HTTP *http.Client
+
+	mu        sync.Mutex
+	message   string // the current signed auth message, if any
+	signature string
+	expiresAt time.Time // when `message` stops being valid
+	notBefore uint64    // messages must be valid from this time or later (see `RevokeSessions`)
+	token     string    // a session token from `Login`, used instead of messages if set
+	tokenExp  time.Time
+	seeds     seedCommitments
+}
+
+// Creates a client for the backend at `url` (e.g. "https://dice.example.com"),
+// authenticating as the owner of `key` to the game at `game`
+func New(url string, game [32]byte, key ed25519.PrivateKey) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(url, "/"),
+		game:  game,
+		key:   key,
+		HTTP:  &http.Client{Timeout: DEFAULT_TIMEOUT},
+		seeds: newSeedCommitments(),
+	}
+}
+
+// The base58 address of the user this client authenticates as
+func (c *Client) User() string {
+	return base58.Encode(c.key.Public().(ed25519.PublicKey))
+}
+
+// An error returned by the backend. Match on `Code`, which is
+// stable, rather than on `Message`, which may change.
+type Error struct {
+	Status  int // the HTTP status
+	Code    string
+	Message string
+	Details map[string]any
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// Reports whether `err` is an `*Error` with the given code
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// Error codes returned by the backend
+const (
+	CODE_INVALID_REQUEST        = "INVALID_REQUEST"
+	CODE_UNKNOWN_ACTION         = "UNKNOWN_ACTION"
+	CODE_METHOD_NOT_ALLOWED     = "METHOD_NOT_ALLOWED"
+	CODE_NOT_FOUND              = "NOT_FOUND"
+	CODE_AUTH_REQUIRED          = "AUTH_REQUIRED"
+	CODE_AUTH_INVALID           = "AUTH_INVALID"
+	CODE_AUTH_EXPIRED           = "AUTH_EXPIRED"
+	CODE_FORBIDDEN              = "FORBIDDEN"
+	CODE_ACCOUNT_FROZEN         = "ACCOUNT_FROZEN"
+	CODE_INSUFFICIENT_BALANCE   = "INSUFFICIENT_BALANCE"
+	CODE_WAGER_OUT_OF_RANGE     = "WAGER_OUT_OF_RANGE"
+	CODE_THRESHOLD_OUT_OF_RANGE = "THRESHOLD_OUT_OF_RANGE"
+	CODE_INVALID_CLIENT_SEED    = "INVALID_CLIENT_SEED"
+	CODE_CAS_CONFLICT           = "CAS_CONFLICT" // lost a race with a concurrent request: safe to retry
+	CODE_UPSTREAM_ERROR         = "UPSTREAM_ERROR"
+	CODE_UPSTREAM_UNAVAILABLE   = "UPSTREAM_UNAVAILABLE" // the aggregator is down: retry later
+	CODE_INTERNAL               = "INTERNAL"
+)
+
+// Returns the fields that authenticate a request: the session
+// token if we're logged in, or else a signed auth message
+func (c *Client) authFields() map[string]any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExp) {
+		return map[string]any{"token": c.token}
+	}
+	return c.signedMessage()
+}
+
+// Returns a signed auth message, signing a new one if the current one
+// is about to expire. `c.mu` must be held.
+func (c *Client) signedMessage() map[string]any {
+	now := time.Now()
+	if c.message == "" || now.Add(AUTH_MESSAGE_RENEW_BEFORE).After(c.expiresAt) {
+		from := max(uint64(now.Unix()), c.notBefore)
+		to := from + uint64(AUTH_MESSAGE_VALIDITY.Seconds())
+		c.message = AuthMessage(c.key.Public().(ed25519.PublicKey), c.game, from, to)
+		c.signature = SignAuthMessage(c.key, c.message)
+		c.expiresAt = time.Unix(int64(to), 0)
+	}
+	return map[string]any{"message": c.message, "signature": c.signature}
+}
+
+// Calls `action` with `params` (a struct or nil), decoding its result into
+// `result`. Auth fields are added to the request if `auth` is set.
+func (c *Client) call(ctx context.Context, action string, params any, auth bool, result any) error {
+	// (1) Build the request, keeping numbers exact
+	fields := map[string]any{}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&fields)
+		if err != nil {
+			return err
+		}
+	}
+	fields["action"] = action
+	if !auth {
+		return c.post(ctx, fields, result)
+	}
+
+	// (2) Authenticate it. If our credentials were revoked by another
+	// client calling `revoke_sessions`, sign a fresh message and retry.
+	for k, v := range c.authFields() {
+		fields[k] = v
+	}
+	err := c.post(ctx, fields, result)
+	if !IsCode(err, CODE_AUTH_EXPIRED) {
+		return err
+	}
+	c.mu.Lock()
+	c.token = ""
+	c.message = ""
+	c.notBefore = max(c.notBefore, uint64(time.Now().Unix()))
+	c.mu.Unlock()
+	delete(fields, "token")
+	for k, v := range c.authFields() {
+		fields[k] = v
+	}
+	return c.post(ctx, fields, result)
+}
+
+// Sends a request to `POST /`, decoding its result into `result`
+func (c *Client) post(ctx context.Context, fields map[string]any, result any) error {
+	action := fields["action"]
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error   string         `json:"error"`
+			Code    string         `json:"code"`
+			Details map[string]any `json:"details"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Code == "" {
+			return fmt.Errorf("%s: unexpected response (HTTP %d): %s", action, res.StatusCode, bytes.TrimSpace(data))
+		}
+		return &Error{
+			Status:  res.StatusCode,
+			Code:    e.Code,
+			Message: e.Error,
+			Details: e.Details,
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return fmt.Errorf("%s: can't decode result: %v", action, err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package client
+
+// The types below mirror those of the backend's actions. Fields are
+// documented on the backend; only client-specific notes are repeated here.
+
+type LoginResult struct {
+	Token     string `json:"token"`
+	UserId    string `json:"userId"`
+	ExpiresAt uint64 `json:"expiresAt"`
+}
+
+type ApiKeyCreateParams struct {
+	Name             string   `json:"name,omitempty"`
+	Scopes           []string `json:"scopes,omitempty"` // "read", "bet" and/or "withdraw"
+	MaxWagerCents    uint64   `json:"maxWagerCents,omitempty"`
+	ExpiresInSeconds uint64   `json:"expiresInSeconds,omitempty"`
+}
+
+type ApiKey struct {
+	Id            uint64   `json:"id"`
+	UserId        string   `json:"userId"`
+	Name          string   `json:"name"`
+	Prefix        string   `json:"prefix"`
+	Scopes        []string `json:"scopes"`
+	MaxWagerCents uint64   `json:"maxWagerCents"`
+	Revoked       bool     `json:"revoked"`
+	CreatedAt     uint64   `json:"createdAt"`
+	ExpiresAt     uint64   `json:"expiresAt"`
+}
+
+type ApiKeyCreateResult struct {
+	ApiKey
+	Key string `json:"key"` // only ever returned here
+}
+
+type GameParams struct {
+	HouseEdgePct        uint64 `json:"houseEdgePct"`
+	MaxBetCents         uint64 `json:"maxBetCents"`
+	UnderMin            uint16 `json:"underMin"`
+	UnderMax            uint16 `json:"underMax"`
+	OverMin             uint16 `json:"overMin"`
+	OverMax             uint16 `json:"overMax"`
+	ClientSeedMinLength int    `json:"clientSeedMinLength"`
+	ClientSeedMaxLength int    `json:"clientSeedMaxLength"`
+	Version             uint64 `json:"version"`
+}
+
+type User struct {
+	Id             string `json:"id"`
+	ServerSeedHash string `json:"serverSeedHash"`
+	ClientSeed     string `json:"clientSeed"`
+	Nonce          uint64 `json:"nonce"`
+	BalanceCents   uint64 `json:"balanceCents"`
+}
+
+type BetParams struct {
+	WagerCents uint64 `json:"wagerCents"`
+	RollUnder  bool   `json:"rollUnder"`
+	Threshold  uint16 `json:"threshold"`
+}
+
+type BetResult struct {
+	Won              bool   `json:"won"`
+	DeltaCents       int64  `json:"deltaCents"`
+	Result           uint16 `json:"result"`
+	SeedPairId       uint64 `json:"seedPairId"`
+	ServerSeedHash   string `json:"serverSeedHash"`
+	ClientSeed       string `json:"clientSeed"`
+	Nonce            uint64 `json:"nonce"`
+	AlgorithmVersion uint8  `json:"algorithmVersion"`
+	HouseEdgePct     uint64 `json:"houseEdgePct"`
+	ParamsVersion    uint64 `json:"paramsVersion"`
+}
+
+type BetBatchParams struct {
+	Bets            []BetParams `json:"bets"`                      // at most 100
+	StopLossCents   uint64      `json:"stopLossCents,omitempty"`   // stop once the batch has lost at least this much
+	TakeProfitCents uint64      `json:"takeProfitCents,omitempty"` // stop once the batch has won at least this much
+}
+
+// Why a batch of bets stopped before placing them all
+const (
+	BET_BATCH_STOP_LOSS            = "stop_loss"
+	BET_BATCH_TAKE_PROFIT          = "take_profit"
+	BET_BATCH_INSUFFICIENT_BALANCE = "insufficient_balance"
+)
+
+type BetBatchResult struct {
+	Results      []BetResult `json:"results"` // one for each bet placed, in order
+	DeltaCents   int64       `json:"deltaCents"`
+	BalanceCents uint64      `json:"balanceCents"`
+	StoppedBy    string      `json:"stoppedBy"` // empty unless the batch stopped early
+}
+
+type VerifyBetParams struct {
+	ServerSeed       string  `json:"serverSeed"`
+	ClientSeed       string  `json:"clientSeed"`
+	Nonce            uint64  `json:"nonce"`
+	RollUnder        bool    `json:"rollUnder"`
+	Threshold        uint16  `json:"threshold"`
+	WagerCents       uint64  `json:"wagerCents,omitempty"`
+	AlgorithmVersion *uint8  `json:"algorithmVersion,omitempty"` // optional: defaults to v1, see `dice.AlgorithmUnrecorded`
+	HouseEdgePct     *uint64 `json:"houseEdgePct,omitempty"`     // optional: defaults to the current edge
+}
+
+type VerifyBetResult struct {
+	ServerSeedHash string `json:"serverSeedHash"`
+	Result         uint16 `json:"result"`
+	Won            bool   `json:"won"`
+	PayoutCents    uint64 `json:"payoutCents"`
+	DeltaCents     int64  `json:"deltaCents"`
+}
+
+type RotateSeedResult struct {
+	// The pair that was just retired, now fully revealed
+	ServerSeed     string `json:"serverSeed"`
+	ServerSeedHash string `json:"serverSeedHash"`
+	ClientSeed     string `json:"clientSeed"`
+	Nonce          uint64 `json:"nonce"`
+	// The pair that will be used for subsequent bets
+	NextServerSeedHash string `json:"nextServerSeedHash"`
+	NextClientSeed     string `json:"nextClientSeed"`
+}
+
+type DepositResult struct {
+	Id  string `json:"id"`
+	Url string `json:"url"` // where the user pays the deposit
+}
+
+type WithdrawResult struct {
+	Id        string `json:"id"`
+	Url       string `json:"url"` // where the user claims the withdrawal
+	ExpiresAt uint64 `json:"expiresAt"`
+}
+
+type Deposit struct {
+	Id                  string  `json:"id"`
+	UserId              string  `json:"userId"`
+	Url                 string  `json:"url"`
+	AmountCents         uint64  `json:"amountCents"`
+	Completed           bool    `json:"completed"`
+	Signature           string  `json:"signature"`
+	Expired             bool    `json:"expired"`
+	CreatedAt           uint64  `json:"createdAt"`
+	ExpiresAt           uint64  `json:"expiresAt"`
+	CompletedAt         *uint64 `json:"completedAt,omitempty"`
+	ConfirmationDelayed bool    `json:"confirmationDelayed,omitempty"`
+}
+
+type Withdrawal struct {
+	Id             string  `json:"id"`
+	UserId         string  `json:"userId"`
+	Url            string  `json:"url"`
+	AmountCents    uint64  `json:"amountCents"`
+	Signature      string  `json:"signature"`
+	Completed      bool    `json:"completed"`
+	ClaimSignature string  `json:"claimSignature,omitempty"`
+	Expired        bool    `json:"expired"`
+	CreatedAt      uint64  `json:"createdAt"`
+	ExpiresAt      uint64  `json:"expiresAt"`
+	CompletedAt    *uint64 `json:"completedAt,omitempty"`
+}
+
+type Bet struct {
+	Id               uint64 `json:"id"`
+	UserId           string `json:"userId"`
+	AmountCents      uint64 `json:"amountCents"`
+	RollUnder        bool   `json:"rollUnder"`
+	Threshold        uint16 `json:"threshold"`
+	Result           uint16 `json:"result"`
+	Won              bool   `json:"won"`
+	SeedPairId       uint64 `json:"seedPairId"`
+	ServerSeed       string `json:"serverSeed,omitempty"` // empty until the seed pair is rotated
+	ClientSeed       string `json:"clientSeed"`
+	Nonce            uint64 `json:"nonce"`
+	AlgorithmVersion uint8  `json:"algorithmVersion"` // 0 if the bet predates seed pairs, and can't be verified
+	HouseEdgePct     uint64 `json:"houseEdgePct"`
+	ParamsVersion    uint64 `json:"paramsVersion"`
+	CreatedAt        uint64 `json:"createdAt"`
+	// Set by `BetList` and `BetPage` if the bet's server seed was checked
+	// against the hash this client was given when making it. Bets made
+	// elsewhere (e.g. by the frontend) can only have their rolls checked.
+	Committed bool `json:"-"`
+}
+
+type BetPage struct {
+	Bets       []Bet  `json:"bets"`
+	NextCursor string `json:"nextCursor"` // empty if there are no more bets
+}
+
+type LedgerEntry struct {
+	Id                uint64 `json:"id"`
+	UserId            string `json:"userId"`
+	Kind              string `json:"kind"`
+	AmountCents       int64  `json:"amountCents"`
+	BalanceAfterCents uint64 `json:"balanceAfterCents"`
+	Reference         string `json:"reference"`
+	CreatedAt         uint64 `json:"createdAt"`
+}
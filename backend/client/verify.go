@@ -0,0 +1,110 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ivypowered/ivy-dice/backend/dice"
+)
+
+// Returned (wrapped) when the backend reveals a server seed that doesn't
+// match what it committed to, or a bet whose roll doesn't follow from its
+// seeds. Either means the game can't be trusted.
+var ErrVerificationFailed = errors.New("provably-fair verification failed")
+
+// The server seed hashes the backend gave this client before revealing
+// the seeds
+type seedCommitments struct {
+	active string            // the hash of the active pair, as last reported
+	pairs  map[uint64]string // seed pair ID -> hash, for the pairs this client bet with
+}
+
+func newSeedCommitments() seedCommitments {
+	return seedCommitments{
+		pairs: map[uint64]string{},
+	}
+}
+
+// Records `hash` as the commitment for the active seed pair
+func (s *seedCommitments) commit(hash string) {
+	if hash != "" {
+		s.active = hash
+	}
+}
+
+// Records the commitment reported by `user_get`
+func (c *Client) commitUser(u User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seeds.commit(u.ServerSeedHash)
+}
+
+// Records the commitment a bet was made under
+func (c *Client) commitBet(r BetResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seeds.commit(r.ServerSeedHash)
+	c.seeds.pairs[r.SeedPairId] = r.ServerSeedHash
+}
+
+// Checks the seed pair revealed by `rotate_seed`. It must be the pair
+// whose hash we were last given, unless we were never given one.
+func (c *Client) verifyRotation(r RotateSeedResult) error {
+	hash, err := dice.HashServerSeed(r.ServerSeed)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVerificationFailed, err)
+	}
+	if hash != r.ServerSeedHash {
+		return fmt.Errorf("%w: revealed server seed hashes to %s, not %s", ErrVerificationFailed, hash, r.ServerSeedHash)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seeds.active != "" && hash != c.seeds.active {
+		return fmt.Errorf("%w: revealed server seed hashes to %s, but the committed hash was %s", ErrVerificationFailed, hash, c.seeds.active)
+	}
+	c.seeds.commit(r.NextServerSeedHash)
+	return nil
+}
+
+// Checks the bets whose server seeds have been revealed. Each roll must
+// follow from its seeds, and the seeds of bets this client made must hash
+// to what it was given when making them, which sets `Committed`. Bets made
+// elsewhere (e.g. by the frontend) can only be checked the first way.
+func (c *Client) verifyBets(bets []Bet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range bets {
+		b := &bets[i]
+		if b.ServerSeed == "" || b.AlgorithmVersion == dice.AlgorithmLegacy {
+			// seed pair hasn't been rotated yet, or the bet
+			// predates seed pairs and can't be verified
+			continue
+		}
+		// (1) Check the server seed against the hash we were given
+		// for its seed pair, if we bet with it
+		hash, err := dice.HashServerSeed(b.ServerSeed)
+		if err != nil {
+			return fmt.Errorf("%w: bet %d: %v", ErrVerificationFailed, b.Id, err)
+		}
+		if committed, ok := c.seeds.pairs[b.SeedPairId]; ok {
+			if hash != committed {
+				return fmt.Errorf("%w: bet %d: revealed server seed hashes to %s, but the bet was made under %s", ErrVerificationFailed, b.Id, hash, committed)
+			}
+			b.Committed = true
+		}
+
+		// (2) Recompute the roll
+		roll, err := dice.Roll(b.AlgorithmVersion, b.ServerSeed, b.ClientSeed, b.Nonce)
+		if err != nil {
+			return fmt.Errorf("%w: bet %d: %v", ErrVerificationFailed, b.Id, err)
+		}
+		if roll != b.Result {
+			return fmt.Errorf("%w: bet %d: recorded roll %d, but its seeds roll %d", ErrVerificationFailed, b.Id, b.Result, roll)
+		}
+		if dice.Won(b.RollUnder, b.Threshold, roll) != b.Won {
+			return fmt.Errorf("%w: bet %d: recorded won=%t for roll %d", ErrVerificationFailed, b.Id, b.Won, roll)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/ivypowered/ivy-dice/backend/dice"
+)
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New("http://127.0.0.1:0", [32]byte{}, key)
+}
+
+// Returns a random server seed and its hash
+func newSeed(t *testing.T) (string, string) {
+	t.Helper()
+	var b [32]byte
+	rand.Read(b[:])
+	seed := hex.EncodeToString(b[:])
+	hash, err := dice.HashServerSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seed, hash
+}
+
+func TestVerifyRotationRequiresActiveHash(t *testing.T) {
+	c := newTestClient(t)
+	oldSeed, oldHash := newSeed(t)
+	seed, hash := newSeed(t)
+	_, nextHash := newSeed(t)
+	c.commitBet(BetResult{SeedPairId: 1, ServerSeedHash: oldHash})
+	c.commitUser(User{ServerSeedHash: hash})
+
+	// a hash we were given once, but that's no longer active
+	err := c.verifyRotation(RotateSeedResult{ServerSeed: oldSeed, ServerSeedHash: oldHash, NextServerSeedHash: nextHash})
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("accepted the reveal of an older seed pair: %v", err)
+	}
+	err = c.verifyRotation(RotateSeedResult{ServerSeed: seed, ServerSeedHash: hash, NextServerSeedHash: nextHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.seeds.active != nextHash {
+		t.Fatalf("active hash is %s after rotating, not %s", c.seeds.active, nextHash)
+	}
+}
+
+func TestVerifyRotationWithoutCommitment(t *testing.T) {
+	c := newTestClient(t)
+	seed, hash := newSeed(t)
+	_, otherHash := newSeed(t)
+
+	err := c.verifyRotation(RotateSeedResult{ServerSeed: seed, ServerSeedHash: otherHash})
+	if !errors.Is(err, ErrVerificationFailed) {
+		t.Fatalf("accepted a seed that doesn't match its own hash: %v", err)
+	}
+	err = c.verifyRotation(RotateSeedResult{ServerSeed: seed, ServerSeedHash: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBets(t *testing.T) {
+	c := newTestClient(t)
+	seed, hash := newSeed(t)
+	otherSeed, _ := newSeed(t)
+	c.commitBet(BetResult{SeedPairId: 1, ServerSeedHash: hash})
+
+	// Returns a bet with `seed`, as the backend would have settled it
+	bet := func(seedPairId uint64, seed string, nonce uint64) Bet {
+		roll, err := dice.Roll(dice.AlgorithmLatest, seed, "client", nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Bet{
+			Id:               nonce,
+			RollUnder:        true,
+			Threshold:        5000,
+			Result:           roll,
+			Won:              dice.Won(true, 5000, roll),
+			SeedPairId:       seedPairId,
+			ServerSeed:       seed,
+			ClientSeed:       "client",
+			Nonce:            nonce,
+			AlgorithmVersion: dice.AlgorithmLatest,
+		}
+	}
+
+	bets := []Bet{
+		bet(1, seed, 0),
+		bet(2, otherSeed, 1), // made elsewhere
+		{Id: 2, Result: 1234, AlgorithmVersion: dice.AlgorithmLegacy, ServerSeed: seed},
+		{Id: 3, Result: 1234, SeedPairId: 1, AlgorithmVersion: dice.AlgorithmLatest}, // not revealed yet
+	}
+	err := c.verifyBets(bets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bets[0].Committed {
+		t.Fatal("bet with a committed seed pair wasn't marked as committed")
+	}
+	if bets[1].Committed {
+		t.Fatal("bet made elsewhere was marked as committed")
+	}
+
+	tests := []struct {
+		name string
+		bet  Bet
+	}{
+		{"seed doesn't match the commitment", bet(1, otherSeed, 0)},
+		{"roll doesn't follow from the seeds", func() Bet {
+			b := bet(2, otherSeed, 0)
+			b.Result = (b.Result + 1) % 10000
+			return b
+		}()},
+		{"won doesn't follow from the roll", func() Bet {
+			b := bet(2, otherSeed, 0)
+			b.Won = !b.Won
+			return b
+		}()},
+	}
+	for _, tt := range tests {
+		err := c.verifyBets([]Bet{tt.bet})
+		if !errors.Is(err, ErrVerificationFailed) {
+			t.Errorf("%s: expected verification to fail, got %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// dice-verify re-checks exported bets offline.
+//
+// It reads `Bet` rows as returned by the `bet_list` action, either as
+// JSON lines or as JSON arrays, from the files given on the command line
+// (or stdin if there are none), and recomputes the roll and outcome of
+// each one. It exits with status 1 if any bet does not verify. Bets that
+// predate seed pairs can't be verified, and are skipped.
+//
+//	dice-verify bets.jsonl
+//	curl ... -d '{"action":"bet_list",...}' | dice-verify
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ivypowered/ivy-dice/backend/dice"
+)
+
+// The subset of the backend's `Bet` needed for verification
+type Bet struct {
+	Id               uint64 `json:"id"`
+	RollUnder        bool   `json:"rollUnder"`
+	Threshold        uint16 `json:"threshold"`
+	Result           uint16 `json:"result"`
+	Won              bool   `json:"won"`
+	ServerSeed       string `json:"serverSeed"`
+	ClientSeed       string `json:"clientSeed"`
+	Nonce            uint64 `json:"nonce"`
+	AlgorithmVersion *uint8 `json:"algorithmVersion"` // missing in exports that predate versioning
+}
+
+type Stats struct {
+	Verified int
+	Skipped  int
+	Failed   int
+}
+
+// Verify a single bet, returning an error describing the mismatch, if any
+func verify(b Bet) error {
+	_, err := dice.HashServerSeed(b.ServerSeed)
+	if err != nil {
+		return err
+	}
+	version := uint8(dice.AlgorithmUnrecorded)
+	if b.AlgorithmVersion != nil {
+		version = *b.AlgorithmVersion
+	}
+	roll, err := dice.Roll(version, b.ServerSeed, b.ClientSeed, b.Nonce)
+	if err != nil {
+		return err
+	}
+	if roll != b.Result {
+		return fmt.Errorf("roll mismatch: recorded %d, computed %d", b.Result, roll)
+	}
+	won := dice.Won(b.RollUnder, b.Threshold, roll)
+	if won != b.Won {
+		return fmt.Errorf("outcome mismatch: recorded won=%t, computed won=%t", b.Won, won)
+	}
+	return nil
+}
+
+// Decode the next bets from `dec`, which may either be a single bet or an array of bets
+func decodeBets(dec *json.Decoder) ([]Bet, error) {
+	var raw json.RawMessage
+	err := dec.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) > 0 && raw[0] == '[' {
+		var bets []Bet
+		err = json.Unmarshal(raw, &bets)
+		return bets, err
+	}
+	var bet Bet
+	err = json.Unmarshal(raw, &bet)
+	return []Bet{bet}, err
+}
+
+func verifyAll(r io.Reader, name string, verbose bool, stats *Stats) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		bets, err := decodeBets(dec)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		for _, b := range bets {
+			if b.ServerSeed == "" {
+				// seed pair hasn't been rotated yet
+				stats.Skipped++
+				if verbose {
+					fmt.Printf("bet %d: SKIP (server seed not yet revealed)\n", b.Id)
+				}
+				continue
+			}
+			if b.AlgorithmVersion != nil && *b.AlgorithmVersion == dice.AlgorithmLegacy {
+				stats.Skipped++
+				if verbose {
+					fmt.Printf("bet %d: SKIP (predates seed pairs, can't be verified)\n", b.Id)
+				}
+				continue
+			}
+			err := verify(b)
+			if err != nil {
+				stats.Failed++
+				fmt.Printf("bet %d: FAIL: %v\n", b.Id, err)
+				continue
+			}
+			stats.Verified++
+			if verbose {
+				fmt.Printf("bet %d: OK\n", b.Id)
+			}
+		}
+	}
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "print a line for every bet, not just failures")
+	flag.Parse()
+
+	var stats Stats
+	var err error
+	if flag.NArg() == 0 {
+		err = verifyAll(os.Stdin, "stdin", *verbose, &stats)
+	}
+	for _, path := range flag.Args() {
+		f, errOpen := os.Open(path)
+		if errOpen != nil {
+			err = errOpen
+			break
+		}
+		err = verifyAll(f, path, *verbose, &stats)
+		f.Close()
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("%d verified, %d skipped, %d failed\n", stats.Verified, stats.Skipped, stats.Failed)
+	if stats.Failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ivypowered/ivy-dice/backend/dice"
+)
+
+// Administrative subcommands, run as `backend <command> [flags]`
+// instead of starting the HTTP server.
+var COMMANDS = map[string]func(args []string) error{
+	"adjust":    cmdAdjust,
+	"reconcile": cmdReconcile,
+	"unfreeze":  cmdUnfreeze,
+}
+
+func runCommand(name string, args []string) error {
+	cmd, ok := COMMANDS[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s", name)
+	}
+	return cmd(args)
+}
+
+// Manually credit or debit a user, recording an adjustment in their ledger.
+func cmdAdjust(args []string) error {
+	fs := flag.NewFlagSet("adjust", flag.ContinueOnError)
+	user := fs.String("user", "", "base58 address of the user to adjust")
+	amount := fs.Int64("amount", 0, "amount in cents to add (negative to subtract)")
+	note := fs.String("note", "", "reason for the adjustment, stored as the ledger reference")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *user == "" || *amount == 0 || *note == "" {
+		fs.Usage()
+		return errors.New("-user, -amount and -note are required")
+	}
+
+	var entry LedgerEntry
+	err = DB.WithTx(func(tx *Tx) error {
+		// make sure the user exists
+		_, err := tx.UserGet(*user)
+		if err != nil {
+			return err
+		}
+		entry, err = tx.UserAdjust(*user, *amount, LEDGER_ADJUSTMENT, *note)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "adjusted %s by %d cents, new balance is %d cents (ledger entry %d)\n",
+		entry.UserId, entry.AmountCents, entry.BalanceAfterCents, entry.Id)
+	return nil
+}
+
+// A user's stored balance, next to the balance we'd expect from their history
+type ReconcileAccount struct {
+	UserId           string `json:"userId"`
+	BalanceCents     uint64 `json:"balanceCents"`
+	ExpectedCents    int64  `json:"expectedCents"` // deposits + bets - withdrawals + adjustments
+	LedgerCents      int64  `json:"ledgerCents"`   // sum of all ledger entries
+	DepositsCents    int64  `json:"depositsCents"`
+	BetsCents        int64  `json:"betsCents"`
+	WithdrawalsCents int64  `json:"withdrawalsCents"`
+	AdjustmentsCents int64  `json:"adjustmentsCents"`
+	Mismatch         bool   `json:"mismatch"`
+	Frozen           bool   `json:"frozen"`
+}
+
+type ReconcileReport struct {
+	CheckedAt  uint64             `json:"checkedAt"`
+	Users      int                `json:"users"`
+	Mismatches int                `json:"mismatches"`
+	Accounts   []ReconcileAccount `json:"accounts"`
+}
+
+// Recompute every user's balance from the deposits, bets and withdrawals tables
+// (plus manual adjustments from the ledger), and report the accounts that don't
+// match as JSON. Exits with an error if there are any mismatches.
+func cmdReconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	freeze := fs.Bool("freeze", false, "freeze mismatching accounts, blocking bets and withdrawals")
+	all := fs.Bool("all", false, "report every account, not just mismatching ones")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	report := ReconcileReport{
+		CheckedAt: uint64(time.Now().Unix()),
+		Accounts:  []ReconcileAccount{},
+	}
+	// read everything inside of a transaction, so we see a consistent snapshot
+	err = DB.WithTx(func(tx *Tx) error {
+		users, err := tx.UserList()
+		if err != nil {
+			return err
+		}
+		deposits, err := tx.DepositTotals()
+		if err != nil {
+			return err
+		}
+		withdrawals, err := tx.WithdrawTotals()
+		if err != nil {
+			return err
+		}
+		adjustments, err := tx.LedgerTotals(LEDGER_ADJUSTMENT)
+		if err != nil {
+			return err
+		}
+		ledger, err := tx.LedgerTotals("")
+		if err != nil {
+			return err
+		}
+		bets := make(map[string]int64)
+		err = tx.BetForEach(func(b Bet) error {
+			outcome := dice.Settle(b.AmountCents, b.RollUnder, b.Threshold, b.Result, b.HouseEdgePct)
+			bets[b.UserId] += outcome.DeltaCents
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		report.Users = len(users)
+		for _, user := range users {
+			account := ReconcileAccount{
+				UserId:           user.Id,
+				BalanceCents:     user.BalanceCents,
+				LedgerCents:      ledger[user.Id],
+				DepositsCents:    deposits[user.Id],
+				BetsCents:        bets[user.Id],
+				WithdrawalsCents: withdrawals[user.Id],
+				AdjustmentsCents: adjustments[user.Id],
+				Frozen:           user.Frozen,
+			}
+			account.ExpectedCents = account.DepositsCents + account.BetsCents - account.WithdrawalsCents + account.AdjustmentsCents
+			account.Mismatch = account.ExpectedCents != int64(user.BalanceCents) || account.LedgerCents != int64(user.BalanceCents)
+			if account.Mismatch {
+				report.Mismatches++
+				if *freeze && !user.Frozen {
+					err = tx.UserSetFrozen(user.Id, true)
+					if err != nil {
+						return err
+					}
+					account.Frozen = true
+				}
+			}
+			if account.Mismatch || *all {
+				report.Accounts = append(report.Accounts, account)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return err
+	}
+	if report.Mismatches > 0 {
+		return fmt.Errorf("%d of %d accounts don't reconcile", report.Mismatches, report.Users)
+	}
+	return nil
+}
+
+// Unfreeze an account that was frozen by `reconcile -freeze`
+func cmdUnfreeze(args []string) error {
+	fs := flag.NewFlagSet("unfreeze", flag.ContinueOnError)
+	user := fs.String("user", "", "base58 address of the user to unfreeze")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *user == "" {
+		fs.Usage()
+		return errors.New("-user is required")
+	}
+	return DB.UserSetFrozen(*user, false)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ivypowered/ivy-dice/backend/dice"
+	"github.com/mr-tron/base58"
+)
+
+// Server configuration. Every setting has a default (see `DefaultConfig`),
+// which can be overridden, in increasing order of precedence, by a TOML
+// file, a `DICE_*` env var, and a command-line flag.
+type Config struct {
+	Port          int    `toml:"port"`
+	DbPath        string `toml:"db_path"`
+	IvyUrl        string `toml:"ivy_url"`
+	AggregatorUrl string `toml:"aggregator_url"`
+	// Base58 addresses of the users allowed to call admin actions
+	Admins []string `toml:"admins"`
+	// Whether API keys may be created with the withdraw scope
+	ApiKeyWithdrawEnabled bool `toml:"api_key_withdraw_enabled"`
+
+	// The initial game parameters, recorded the first time the backend starts.
+	// After that the recorded parameters are used, and changes made here only
+	// take effect on SIGHUP: see `LoadGameParams` and `ReloadGameParams`.
+	Game GameConfig `toml:"game"`
+}
+
+// The parameters of the dice game itself
+type GameConfig struct {
+	HouseEdgePct        uint64 `toml:"house_edge_pct" json:"houseEdgePct"`
+	MaxBetCents         uint64 `toml:"max_bet_cents" json:"maxBetCents"`
+	UnderMin            uint16 `toml:"under_min" json:"underMin"`
+	UnderMax            uint16 `toml:"under_max" json:"underMax"`
+	OverMin             uint16 `toml:"over_min" json:"overMin"`
+	OverMax             uint16 `toml:"over_max" json:"overMax"`
+	ClientSeedMinLength int    `toml:"client_seed_min_length" json:"clientSeedMinLength"`
+	ClientSeedMaxLength int    `toml:"client_seed_max_length" json:"clientSeedMaxLength"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Port:          8000,
+		DbPath:        "./backend.db",
+		IvyUrl:        "https://ivypowered.com",
+		AggregatorUrl: "http://127.0.0.1:5000",
+		Game: GameConfig{
+			HouseEdgePct:        1,
+			MaxBetCents:         300000_00,
+			UnderMin:            1,
+			UnderMax:            9802,
+			OverMin:             197,
+			OverMax:             9899,
+			ClientSeedMinLength: 6,
+			ClientSeedMaxLength: 32,
+		},
+	}
+}
+
+// A setting that can be overridden from the environment or command line
+type configOption struct {
+	name  string // the flag name; the env var is DICE_ + the name in SCREAMING_SNAKE
+	usage string
+	field func(c *Config) any
+}
+
+var CONFIG_OPTIONS = []configOption{
+	{"port", "port to listen on", func(c *Config) any { return &c.Port }},
+	{"db-path", "path to the SQLite database", func(c *Config) any { return &c.DbPath }},
+	{"ivy-url", "base URL of the Ivy website", func(c *Config) any { return &c.IvyUrl }},
+	{"aggregator-url", "base URL of the Ivy aggregator", func(c *Config) any { return &c.AggregatorUrl }},
+	{"admins", "comma-separated addresses of admin users", func(c *Config) any { return &c.Admins }},
+	{"api-key-withdraw-enabled", "allow API keys with the withdraw scope", func(c *Config) any { return &c.ApiKeyWithdrawEnabled }},
+	{"house-edge-pct", "house edge, in percent", func(c *Config) any { return &c.Game.HouseEdgePct }},
+	{"max-bet-cents", "maximum wager, in cents", func(c *Config) any { return &c.Game.MaxBetCents }},
+	{"under-min", "minimum roll-under threshold", func(c *Config) any { return &c.Game.UnderMin }},
+	{"under-max", "maximum roll-under threshold", func(c *Config) any { return &c.Game.UnderMax }},
+	{"over-min", "minimum roll-over threshold", func(c *Config) any { return &c.Game.OverMin }},
+	{"over-max", "maximum roll-over threshold", func(c *Config) any { return &c.Game.OverMax }},
+	{"client-seed-min-length", "minimum client seed length", func(c *Config) any { return &c.Game.ClientSeedMinLength }},
+	{"client-seed-max-length", "maximum client seed length", func(c *Config) any { return &c.Game.ClientSeedMaxLength }},
+}
+
+func (o configOption) env() string {
+	return "DICE_" + strings.ToUpper(strings.ReplaceAll(o.name, "-", "_"))
+}
+
+// Parse `value` into the field `o` refers to in `c`
+func (o configOption) set(c *Config, value string) error {
+	var err error
+	switch p := o.field(c).(type) {
+	case *string:
+		*p = value
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *int:
+		*p, err = strconv.Atoi(value)
+	case *uint64:
+		*p, err = strconv.ParseUint(value, 10, 64)
+	case *[]string:
+		*p = nil
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*p = append(*p, v)
+			}
+		}
+	case *uint16:
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 16)
+		*p = uint16(v)
+	default:
+		panic("unsupported config option type")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %v", o.name, value, err)
+	}
+	return nil
+}
+
+// Load the configuration from `args` (without the program name), the
+// environment, and the config file named by `-config` or `DICE_CONFIG`.
+// Returns the loaded config and the remaining non-flag arguments.
+func LoadConfig(args []string) (Config, []string, error) {
+	// (1) Parse flags, holding on to their values until the end
+	fs := flag.NewFlagSet("backend", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backend [flags] [command [args]]")
+		fs.PrintDefaults()
+	}
+	path := fs.String("config", os.Getenv("DICE_CONFIG"), "path to a TOML config file (env DICE_CONFIG)")
+	type override struct {
+		option configOption
+		value  string
+	}
+	var overrides []override
+	for _, o := range CONFIG_OPTIONS {
+		usage := o.usage + " (env " + o.env() + ")"
+		set := func(value string) error {
+			overrides = append(overrides, override{o, value})
+			return nil
+		}
+		if _, ok := o.field(&Config{}).(*bool); ok {
+			// allow `-name` as well as `-name=true`
+			fs.BoolFunc(o.name, usage, set)
+		} else {
+			fs.Func(o.name, usage, set)
+		}
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	// (2) Apply the config file
+	c := DefaultConfig()
+	if *path != "" {
+		md, err := toml.DecodeFile(*path, &c)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return Config{}, nil, fmt.Errorf("%s: unknown setting %s", *path, undecoded[0])
+		}
+	}
+
+	// (3) Apply env vars
+	for _, o := range CONFIG_OPTIONS {
+		value, ok := os.LookupEnv(o.env())
+		if !ok {
+			continue
+		}
+		err = o.set(&c, value)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("%s: %v", o.env(), err)
+		}
+	}
+
+	// (4) Apply flags
+	for _, f := range overrides {
+		err = f.option.set(&c, f.value)
+		if err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return Config{}, nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return c, fs.Args(), nil
+}
+
+func (c Config) Validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", c.Port)
+	}
+	if c.DbPath == "" {
+		return errors.New("db_path is required")
+	}
+	for name, u := range map[string]string{"ivy_url": c.IvyUrl, "aggregator_url": c.AggregatorUrl} {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("%s must be an http(s) URL, got %q", name, u)
+		}
+		if strings.HasSuffix(u, "/") {
+			return fmt.Errorf("%s must not end with a slash", name)
+		}
+	}
+	for _, admin := range c.Admins {
+		key, err := base58.Decode(admin)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("admin %q is not a valid address", admin)
+		}
+	}
+	return c.Game.Validate()
+}
+
+// Validate a roll-under or roll-over threshold
+func (g GameConfig) ValidateThreshold(rollUnder bool, threshold uint16) error {
+	var e *Error
+	min, max := g.OverMin, g.OverMax
+	if rollUnder {
+		min, max = g.UnderMin, g.UnderMax
+		if threshold < min {
+			e = Errorf(CODE_THRESHOLD_OUT_OF_RANGE, "invalid threshold: minimum amount to roll under is %d, but got %d", min, threshold)
+		} else if threshold > max {
+			e = Errorf(CODE_THRESHOLD_OUT_OF_RANGE, "invalid threshold: maximum amount to roll under is %d, but got %d", max, threshold)
+		}
+	} else {
+		if threshold < min {
+			e = Errorf(CODE_THRESHOLD_OUT_OF_RANGE, "invalid threshold: minimum amount to roll over is %d, but got %d", min, threshold)
+		} else if threshold > max {
+			e = Errorf(CODE_THRESHOLD_OUT_OF_RANGE, "invalid threshold: maximum amount to roll over is %d, but got %d", max, threshold)
+		}
+	}
+	if e == nil {
+		return nil
+	}
+	e.Details = map[string]any{"min": min, "max": max, "threshold": threshold}
+	return e
+}
+
+// Validate a user-provided client seed
+func (g GameConfig) ValidateClientSeed(clientSeed string) error {
+	if len(clientSeed) < g.ClientSeedMinLength || len(clientSeed) > g.ClientSeedMaxLength {
+		e := Errorf(CODE_INVALID_CLIENT_SEED, "incorrect client seed length: got %d, but must be within interval [%d, %d]", len(clientSeed), g.ClientSeedMinLength, g.ClientSeedMaxLength)
+		e.Details = map[string]any{"minLength": g.ClientSeedMinLength, "maxLength": g.ClientSeedMaxLength, "length": len(clientSeed)}
+		return e
+	}
+	return nil
+}
+
+// The largest wager payouts can be computed for without overflowing,
+// as they're computed as wager * 10000 * (100 - edge)
+const MAX_WAGER_CENTS = math.MaxUint64 / 1_000_000
+
+func (g GameConfig) Validate() error {
+	if g.HouseEdgePct >= 100 {
+		return fmt.Errorf("house_edge_pct must be below 100, got %d", g.HouseEdgePct)
+	}
+	if g.MaxBetCents == 0 {
+		return errors.New("max_bet_cents must be positive")
+	}
+	if g.MaxBetCents > MAX_WAGER_CENTS {
+		return fmt.Errorf("max_bet_cents %d is too large", g.MaxBetCents)
+	}
+	if g.ClientSeedMinLength < 1 || g.ClientSeedMinLength > g.ClientSeedMaxLength {
+		return fmt.Errorf("client seed length bounds [%d, %d] are invalid", g.ClientSeedMinLength, g.ClientSeedMaxLength)
+	}
+	// Every allowed threshold must be winnable...
+	if g.UnderMin < 1 || g.UnderMin > g.UnderMax {
+		return fmt.Errorf("roll-under bounds [%d, %d] are invalid", g.UnderMin, g.UnderMax)
+	}
+	if g.OverMax > 9998 || g.OverMin > g.OverMax {
+		return fmt.Errorf("roll-over bounds [%d, %d] are invalid", g.OverMin, g.OverMax)
+	}
+	// ...and even the likeliest win must pay out more than the wager,
+	// otherwise the house edge eats the whole reward
+	const wager = 100_00
+	under := dice.Settle(wager, true, g.UnderMax, 0, g.HouseEdgePct)
+	if under.DeltaCents <= 0 {
+		return fmt.Errorf("under_max %d is too high for a %d%% house edge: a win wouldn't pay anything", g.UnderMax, g.HouseEdgePct)
+	}
+	over := dice.Settle(wager, false, g.OverMin, 9999, g.HouseEdgePct)
+	if over.DeltaCents <= 0 {
+		return fmt.Errorf("over_min %d is too low for a %d%% house edge: a win wouldn't pay anything", g.OverMin, g.HouseEdgePct)
+	}
+	return nil
+}
@@ -3,13 +3,31 @@ package main
 import (
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 )
 
 type User struct {
 	Id           string `json:"id"`
-	ServerSeed   string `json:"serverSeed"`
 	BalanceCents uint64 `json:"balanceCents"`
+	Frozen       bool   `json:"frozen"` // set by `reconcile -freeze`, blocks bets and withdrawals
+}
+
+// A server seed + client seed pair. Every bet made with a pair
+// consumes the current nonce and increments it. The server seed
+// is only revealed once the pair is rotated out (`active` = false).
+type SeedPair struct {
+	Id         uint64  `json:"id"`
+	UserId     string  `json:"userId"`
+	ServerSeed string  `json:"serverSeed"`
+	ClientSeed string  `json:"clientSeed"`
+	Nonce      uint64  `json:"nonce"`
+	Active     bool    `json:"active"`
+	CreatedAt  uint64  `json:"createdAt"`
+	RevealedAt *uint64 `json:"revealedAt,omitempty"`
 }
 
 type Deposit struct {
@@ -19,45 +37,202 @@ type Deposit struct {
 	AmountCents uint64  `json:"amountCents"`
 	Completed   bool    `json:"completed"`
 	Signature   string  `json:"signature"`
+	Expired     bool    `json:"expired"` // abandoned before being paid
 	CreatedAt   uint64  `json:"createdAt"`
+	ExpiresAt   uint64  `json:"expiresAt"`
 	CompletedAt *uint64 `json:"completedAt,omitempty"`
+	// Not stored: set when the aggregator couldn't be reached, so the
+	// deposit may have been paid without us knowing yet
+	ConfirmationDelayed bool `json:"confirmationDelayed,omitempty"`
 }
 
 type Withdrawal struct {
-	Id          string `json:"id"`
-	UserId      string `json:"userId"`
-	Url         string `json:"url"`
-	AmountCents uint64 `json:"amountCents"`
-	Signature   string `json:"signature"`
-	CreatedAt   uint64 `json:"createdAt"`
+	Id             string  `json:"id"`
+	UserId         string  `json:"userId"`
+	Url            string  `json:"url"`
+	AmountCents    uint64  `json:"amountCents"`
+	Signature      string  `json:"signature"`                // our withdraw authority signature
+	Completed      bool    `json:"completed"`                // claimed on-chain
+	ClaimSignature string  `json:"claimSignature,omitempty"` // signature of the claim transaction
+	Expired        bool    `json:"expired"`                  // not claimed in time, and refunded (also completed if it was claimed anyway)
+	CreatedAt      uint64  `json:"createdAt"`
+	ExpiresAt      uint64  `json:"expiresAt"`
+	CompletedAt    *uint64 `json:"completedAt,omitempty"`
+}
+
+// Kinds of ledger entries
+const (
+	LEDGER_OPENING             = "opening" // balance that predates the ledger
+	LEDGER_DEPOSIT             = "deposit"
+	LEDGER_BET_STAKE           = "bet_stake"
+	LEDGER_BET_PAYOUT          = "bet_payout"
+	LEDGER_WITHDRAWAL          = "withdrawal"
+	LEDGER_WITHDRAWAL_REFUND   = "withdrawal_refund"
+	LEDGER_WITHDRAWAL_CLAWBACK = "withdrawal_clawback" // refund taken back, as the withdrawal was claimed late
+	LEDGER_ADJUSTMENT          = "adjustment"
+)
+
+// A single movement of a user's balance. `Reference` is the ID of the
+// deposit, bet or withdrawal that caused it, or a note for adjustments.
+type LedgerEntry struct {
+	Id                uint64 `json:"id"`
+	UserId            string `json:"userId"`
+	Kind              string `json:"kind"`
+	AmountCents       int64  `json:"amountCents"`
+	BalanceAfterCents uint64 `json:"balanceAfterCents"`
+	Reference         string `json:"reference"`
+	CreatedAt         uint64 `json:"createdAt"`
 }
 
 type Bet struct {
-	Id          uint64 `json:"id"`
-	UserId      string `json:"userId"`
-	AmountCents uint64 `json:"amountCents"`
-	RollUnder   bool   `json:"rollUnder"`
-	Threshold   uint16 `json:"threshold"`
-	Result      uint16 `json:"result"`
-	Won         bool   `json:"won"`
-	ServerSeed  string `json:"serverSeed"`
-	CreatedAt   uint64 `json:"createdAt"`
+	Id               uint64 `json:"id"`
+	UserId           string `json:"userId"`
+	AmountCents      uint64 `json:"amountCents"`
+	RollUnder        bool   `json:"rollUnder"`
+	Threshold        uint16 `json:"threshold"`
+	Result           uint16 `json:"result"`
+	Won              bool   `json:"won"`
+	SeedPairId       uint64 `json:"seedPairId"`
+	ServerSeed       string `json:"serverSeed,omitempty"` // empty until the seed pair is rotated
+	ClientSeed       string `json:"clientSeed"`
+	Nonce            uint64 `json:"nonce"`
+	AlgorithmVersion uint8  `json:"algorithmVersion"` // 0 if the bet predates seed pairs, and can't be verified
+	HouseEdgePct     uint64 `json:"houseEdgePct"`
+	ParamsVersion    uint64 `json:"paramsVersion"` // 0 if the bet predates versioned game parameters
+	CreatedAt        uint64 `json:"createdAt"`
+}
+
+type ApiKey struct {
+	Id            uint64   `json:"id"`
+	UserId        string   `json:"userId"`
+	Name          string   `json:"name"`
+	Prefix        string   `json:"prefix"` // the start of the key, to tell keys apart
+	Scopes        []string `json:"scopes"`
+	MaxWagerCents uint64   `json:"maxWagerCents"` // 0 if only limited by the game's max bet
+	Revoked       bool     `json:"revoked"`
+	CreatedAt     uint64   `json:"createdAt"`
+	ExpiresAt     uint64   `json:"expiresAt"`
+}
+
+// The subset of *sql.DB and *sql.Tx that our queries need
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Queries can run either directly against the database,
+// or inside of a transaction (see `Database.WithTx`).
+type Queries struct {
+	querier
+	// The ledger entries written so far, if inside of a transaction
+	ledger *[]LedgerEntry
 }
 
 type Database struct {
-	*sql.DB
+	Queries
+	db *sql.DB
+	// Called with every ledger entry once its transaction has committed,
+	// e.g. to push balance changes to the user
+	OnLedgerEntry func(entry LedgerEntry)
+}
+
+type Tx struct {
+	Queries
+}
+
+func NewDatabase(db *sql.DB) Database {
+	return Database{
+		Queries: Queries{querier: db},
+		db:      db,
+	}
+}
+
+// Runs `f` inside of a transaction. The transaction is committed
+// if `f` returns nil, and rolled back otherwise.
+func (db Database) WithTx(f func(tx *Tx) error) error {
+	sqlTx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	var ledger []LedgerEntry
+	err = f(&Tx{Queries{querier: sqlTx, ledger: &ledger}})
+	if err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	err = sqlTx.Commit()
+	if err != nil {
+		return err
+	}
+	if db.OnLedgerEntry != nil {
+		for _, entry := range ledger {
+			db.OnLedgerEntry(entry)
+		}
+	}
+	return nil
 }
 
 func (db Database) Startup() error {
 	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
         id TEXT PRIMARY KEY,
-        serverSeed TEXT NOT NULL,
         balanceCents INTEGER NOT NULL
     )`)
 	if err != nil {
 		return err
 	}
 
+	err = db.columnAdd("users", "frozen", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	// auth messages valid from before this time are rejected, see `revoke_sessions`
+	err = db.columnAdd("users", "authNotBefore", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS seed_pairs (
+        id INTEGER PRIMARY KEY,
+        userId TEXT NOT NULL,
+        serverSeed TEXT NOT NULL,
+        clientSeed TEXT NOT NULL,
+        nonce INTEGER NOT NULL DEFAULT 0,
+        active BOOLEAN NOT NULL DEFAULT 1,
+        createdAt INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+        revealedAt INTEGER,
+        FOREIGN KEY (userId) REFERENCES users(id)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idxSeedPairsActive ON seed_pairs(userId) WHERE active = 1`)
+	if err != nil {
+		return err
+	}
+
+	// Older databases kept a single server seed on the user row.
+	// It has already been committed to (its hash was shown to the
+	// user), so move it into an active seed pair instead of discarding it.
+	legacySeed, err := db.columnExists("users", "serverSeed")
+	if err != nil {
+		return err
+	}
+	if legacySeed {
+		err = db.WithTx(func(tx *Tx) error {
+			_, err := tx.Exec(`INSERT INTO seed_pairs (userId, serverSeed, clientSeed)
+                               SELECT id, serverSeed, lower(hex(randomblob(8))) FROM users`)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`ALTER TABLE users DROP COLUMN serverSeed`)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bets (
         id INTEGER PRIMARY KEY,
         userId TEXT NOT NULL,
@@ -70,6 +245,39 @@ func (db Database) Startup() error {
         createdAt INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
         FOREIGN KEY (userId) REFERENCES users(id)
     )`)
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("bets", "seedPairId", "INTEGER REFERENCES seed_pairs(id)")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("bets", "clientSeed", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("bets", "nonce", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	// bets that predate seed pairs were rolled without a nonce, and their
+	// client seed wasn't recorded, so they're marked as unverifiable
+	err = db.columnAdd("bets", "algorithmVersion", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	// Earlier versions of this migration labelled them v1. Every bet
+	// since has a seed pair, so they're easy to find.
+	_, err = db.Exec(`UPDATE bets SET algorithmVersion = 0 WHERE seedPairId IS NULL`)
+	if err != nil {
+		return err
+	}
+	// bets that predate versioned game parameters were all settled with a 1% edge
+	err = db.columnAdd("bets", "houseEdgePct", "INTEGER NOT NULL DEFAULT 1")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("bets", "paramsVersion", "INTEGER NOT NULL DEFAULT 0")
 	if err != nil {
 		return err
 	}
@@ -93,6 +301,34 @@ func (db Database) Startup() error {
         completedAt INTEGER,
         FOREIGN KEY (userId) REFERENCES users(id)
     )`)
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("deposits", "expired", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("deposits", "expiresAt", "INTEGER")
+	if err != nil {
+		return err
+	}
+	// deposits that predate expiry get an expiry starting from their creation
+	_, err = db.Exec(`UPDATE deposits SET expiresAt = createdAt + ? WHERE expiresAt IS NULL`,
+		int64(DEPOSIT_INTENT_TTL.Seconds()))
+	if err != nil {
+		return err
+	}
+	// when the deposit watcher should next check a pending deposit,
+	// and how many seconds it waited before that
+	err = db.columnAdd("deposits", "checkAt", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("deposits", "checkDelay", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idxDepositsPendingCheckAt ON deposits(checkAt) WHERE completed = 0 AND expired = 0`)
 	if err != nil {
 		return err
 	}
@@ -117,6 +353,37 @@ func (db Database) Startup() error {
 	if err != nil {
 		return err
 	}
+	err = db.columnAdd("withdrawals", "completed", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("withdrawals", "claimSignature", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("withdrawals", "completedAt", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("withdrawals", "expired", "BOOLEAN NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = db.columnAdd("withdrawals", "expiresAt", "INTEGER")
+	if err != nil {
+		return err
+	}
+	// when an expired withdrawal was last checked for a late claim
+	err = db.columnAdd("withdrawals", "checkedAt", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	// withdrawals that predate the claim window get one starting from their creation
+	_, err = db.Exec(`UPDATE withdrawals SET expiresAt = createdAt + ? WHERE expiresAt IS NULL`,
+		int64(WITHDRAW_CLAIM_WINDOW.Seconds()))
+	if err != nil {
+		return err
+	}
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idxWithdrawalsUserId ON withdrawals(userId)`)
 	if err != nil {
 		return err
@@ -126,52 +393,303 @@ func (db Database) Startup() error {
 		return err
 	}
 
+	ledgerExists, err := db.tableExists("ledger_entries")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ledger_entries (
+        id INTEGER PRIMARY KEY,
+        userId TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        amountCents INTEGER NOT NULL,
+        balanceAfterCents INTEGER NOT NULL,
+        reference TEXT NOT NULL DEFAULT '',
+        createdAt INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+        FOREIGN KEY (userId) REFERENCES users(id)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idxLedgerEntriesUserId ON ledger_entries(userId, id)`)
+	if err != nil {
+		return err
+	}
+	if !ledgerExists {
+		// Open the ledger with each user's current balance,
+		// so that entries always add up to `balanceCents`
+		_, err = db.Exec(`INSERT INTO ledger_entries (userId, kind, amountCents, balanceAfterCents)
+                          SELECT id, ?, balanceCents, balanceCents FROM users WHERE balanceCents != 0`, LEDGER_OPENING)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS revoked_sessions (
+        id TEXT PRIMARY KEY,
+        expiresAt INTEGER NOT NULL
+    )`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS api_keys (
+        id INTEGER PRIMARY KEY,
+        userId TEXT NOT NULL,
+        keyHash TEXT NOT NULL UNIQUE,
+        name TEXT NOT NULL,
+        prefix TEXT NOT NULL,
+        scopes TEXT NOT NULL,
+        maxWagerCents INTEGER NOT NULL,
+        revoked BOOLEAN NOT NULL DEFAULT 0,
+        createdAt INTEGER NOT NULL,
+        expiresAt INTEGER NOT NULL,
+        FOREIGN KEY (userId) REFERENCES users(id)
+    )`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idxApiKeysUserId ON api_keys(userId)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS game_params (
+        version INTEGER PRIMARY KEY,
+        params TEXT NOT NULL,
+        createdAt INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+    )`)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func (db Database) UserGet(id string) (User, error) {
-	var serverSeed string
+// Returns whether a table named `table` exists.
+func (db Queries) tableExists(table string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, table).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Returns whether `table` has a column named `column`.
+func (db Queries) columnExists(table string, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Adds a column to an existing table, unless it's already there.
+func (db Queries) columnAdd(table string, column string, definition string) error {
+	exists, err := db.columnExists(table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
+func (db Queries) UserGet(id string) (User, error) {
 	var balanceCents uint64
-	err := db.QueryRow("SELECT serverSeed, balanceCents FROM users WHERE id = ?", id).Scan(&serverSeed, &balanceCents)
+	var frozen bool
+	err := db.QueryRow("SELECT balanceCents, frozen FROM users WHERE id = ?", id).Scan(&balanceCents, &frozen)
 	if err == sql.ErrNoRows {
-		seedBytes := NewServerSeed()
-		serverSeed = hex.EncodeToString(seedBytes[:])
 		balanceCents = 0
-		_, err = db.Exec(`INSERT INTO users (id, serverSeed, balanceCents) VALUES (?, ?, ?)`, id, serverSeed, balanceCents)
+		_, err = db.Exec(`INSERT INTO users (id, balanceCents) VALUES (?, ?)`, id, balanceCents)
 	}
 	if err != nil {
 		return User{}, err
 	}
 	return User{
 		Id:           id,
-		ServerSeed:   serverSeed,
 		BalanceCents: balanceCents,
+		Frozen:       frozen,
 	}, nil
 }
 
-func (db Database) UserCredit(id string, amountCents uint64) error {
-	res, err := db.Exec("UPDATE users SET balanceCents = balanceCents + ? WHERE id = ?", amountCents, id)
+func (db Queries) UserList() ([]User, error) {
+	rows, err := db.Query(`SELECT id, balanceCents, frozen FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.Id, &user.BalanceCents, &user.Frozen)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func (db Queries) UserSetFrozen(id string, frozen bool) error {
+	result, err := db.Exec(`UPDATE users SET frozen = ? WHERE id = ?`, frozen, id)
 	if err != nil {
 		return err
 	}
-	aff, err := res.RowsAffected()
+	affected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-	if aff < 1 {
-		return errors.New("could not credit user: no rows affected")
+	if affected < 1 {
+		return errors.New("could not freeze user: can't find provided ID in db")
 	}
 	return nil
 }
 
-func (db Database) UserCompareExchange(expected User, desired User) error {
-	if expected.Id != desired.Id {
-		return errors.New("mismatching user IDs for compare-and-swap")
+// Adds `deltaCents` to the user's balance and records the movement in the
+// ledger, failing if the balance would go negative. Should be run inside of
+// a transaction together with whatever caused the movement.
+func (db Queries) UserAdjust(id string, deltaCents int64, kind string, reference string) (LedgerEntry, error) {
+	var balanceAfterCents uint64
+	err := db.QueryRow(`UPDATE users SET balanceCents = balanceCents + ?
+                        WHERE id = ? AND balanceCents + ? >= 0 RETURNING balanceCents`,
+		deltaCents, id, deltaCents).Scan(&balanceAfterCents)
+	if err == sql.ErrNoRows {
+		return LedgerEntry{}, NewError(CODE_INSUFFICIENT_BALANCE, "could not adjust user balance: user not found or insufficient balance")
+	}
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	entry := LedgerEntry{
+		UserId:            id,
+		Kind:              kind,
+		AmountCents:       deltaCents,
+		BalanceAfterCents: balanceAfterCents,
+		Reference:         reference,
+	}
+	err = db.QueryRow(`INSERT INTO ledger_entries (userId, kind, amountCents, balanceAfterCents, reference)
+                       VALUES (?, ?, ?, ?, ?) RETURNING id, createdAt`,
+		entry.UserId, entry.Kind, entry.AmountCents, entry.BalanceAfterCents, entry.Reference).Scan(&entry.Id, &entry.CreatedAt)
+	if err != nil {
+		return LedgerEntry{}, err
+	}
+	if db.ledger != nil {
+		*db.ledger = append(*db.ledger, entry)
+	}
+	return entry, nil
+}
+
+// Credits `amountCents` to the user, see `UserAdjust`.
+func (db Queries) UserCredit(id string, amountCents uint64, kind string, reference string) error {
+	_, err := db.UserAdjust(id, int64(amountCents), kind, reference)
+	return err
+}
+
+// Runs a query selecting (userId, total) rows, and collects them into a map
+func (db Queries) totalsByUser(query string, args ...any) (map[string]int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]int64)
+	for rows.Next() {
+		var userId string
+		var total int64
+		err := rows.Scan(&userId, &total)
+		if err != nil {
+			return nil, err
+		}
+		totals[userId] = total
+	}
+
+	return totals, nil
+}
+
+// Total amount of completed deposits, per user
+func (db Queries) DepositTotals() (map[string]int64, error) {
+	return db.totalsByUser(`SELECT userId, SUM(amountCents) FROM deposits WHERE completed = 1 GROUP BY userId`)
+}
+
+// Total amount withdrawn, per user. Expired withdrawals were refunded, so they
+// don't count, unless they were claimed anyway.
+func (db Queries) WithdrawTotals() (map[string]int64, error) {
+	return db.totalsByUser(`SELECT userId, SUM(amountCents) FROM withdrawals WHERE expired = 0 OR completed = 1 GROUP BY userId`)
+}
+
+// Sum of ledger entries of the given kind (or of all kinds, if empty), per user
+func (db Queries) LedgerTotals(kind string) (map[string]int64, error) {
+	if kind == "" {
+		return db.totalsByUser(`SELECT userId, SUM(amountCents) FROM ledger_entries GROUP BY userId`)
+	}
+	return db.totalsByUser(`SELECT userId, SUM(amountCents) FROM ledger_entries WHERE kind = ? GROUP BY userId`, kind)
+}
+
+func (db Queries) LedgerList(userId string, count int, skip int) ([]LedgerEntry, error) {
+	rows, err := db.Query(`SELECT id, userId, kind, amountCents, balanceAfterCents, reference, createdAt
+                          FROM ledger_entries WHERE userId = ? ORDER BY id DESC LIMIT ? OFFSET ?`,
+		userId, count, skip)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []LedgerEntry{}
+	for rows.Next() {
+		var entry LedgerEntry
+		err := rows.Scan(&entry.Id, &entry.UserId, &entry.Kind, &entry.AmountCents,
+			&entry.BalanceAfterCents, &entry.Reference, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Scans a seed pair from `row`, which must select
+// id, userId, serverSeed, clientSeed, nonce, active, createdAt, revealedAt
+func seedPairScan(row interface{ Scan(...any) error }) (SeedPair, error) {
+	var sp SeedPair
+	var revealedAt sql.NullInt64
+	err := row.Scan(&sp.Id, &sp.UserId, &sp.ServerSeed, &sp.ClientSeed, &sp.Nonce,
+		&sp.Active, &sp.CreatedAt, &revealedAt)
+	if revealedAt.Valid {
+		revealedAt := uint64(revealedAt.Int64)
+		sp.RevealedAt = &revealedAt
 	}
-	result, err := db.Exec(
-		`UPDATE users SET serverSeed = ?, balanceCents = ? WHERE id = ? AND serverSeed = ? AND balanceCents = ?`,
-		desired.ServerSeed, desired.BalanceCents, expected.Id, expected.ServerSeed, expected.BalanceCents,
-	)
+	return sp, err
+}
+
+// Gets the active seed pair for the given user,
+// creating one with a random client seed if none exists.
+func (db Queries) SeedPairGetActive(userId string) (SeedPair, error) {
+	sp, err := seedPairScan(db.QueryRow(`SELECT id, userId, serverSeed, clientSeed, nonce, active, createdAt, revealedAt
+                                          FROM seed_pairs WHERE userId = ? AND active = 1`, userId))
+	if err == sql.ErrNoRows {
+		serverSeed := NewServerSeed()
+		_, err = db.Exec(`INSERT INTO seed_pairs (userId, serverSeed, clientSeed) VALUES (?, ?, ?)`,
+			userId, hex.EncodeToString(serverSeed[:]), NewClientSeed())
+		if err != nil {
+			return SeedPair{}, err
+		}
+		return db.SeedPairGetActive(userId)
+	}
+	return sp, err
+}
+
+// Returned when a seed pair was used or rotated by a concurrent request
+var ErrSeedPairConflict = NewError(CODE_CAS_CONFLICT, "seed pair compare-and-swap failed: it was used or rotated concurrently, please retry")
+
+// Atomically consumes the next `count` nonces of the given seed pair.
+// Fails if the pair has been used or rotated since it was read.
+func (db Queries) SeedPairAdvanceNonce(sp SeedPair, count uint64) error {
+	result, err := db.Exec(`UPDATE seed_pairs SET nonce = nonce + ? WHERE id = ? AND nonce = ? AND active = 1`,
+		count, sp.Id, sp.Nonce)
 	if err != nil {
 		return err
 	}
@@ -180,27 +698,51 @@ func (db Database) UserCompareExchange(expected User, desired User) error {
 		return err
 	}
 	if affected < 1 {
-		return errors.New("user compare-and-swap failed: no matching row found")
+		return ErrSeedPairConflict
 	}
 	return nil
 }
 
-func (db Database) DepositCreate(id string, userId string, url string, amountCents uint64) error {
-	_, err := db.Exec(`INSERT INTO deposits (id, userId, url, amountCents) VALUES (?, ?, ?, ?)`,
-		id, userId, url, amountCents)
+// Deactivates (and thereby reveals) the provided seed pair,
+// replacing it with a fresh server seed and the given client seed.
+// Returns the new active pair. Should be run inside of a transaction.
+func (db Queries) SeedPairRotate(sp SeedPair, clientSeed string) (SeedPair, error) {
+	result, err := db.Exec(`UPDATE seed_pairs SET active = 0, revealedAt = strftime('%s', 'now')
+                            WHERE id = ? AND nonce = ? AND active = 1`, sp.Id, sp.Nonce)
+	if err != nil {
+		return SeedPair{}, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return SeedPair{}, err
+	}
+	if affected < 1 {
+		return SeedPair{}, ErrSeedPairConflict
+	}
+	serverSeed := NewServerSeed()
+	_, err = db.Exec(`INSERT INTO seed_pairs (userId, serverSeed, clientSeed) VALUES (?, ?, ?)`,
+		sp.UserId, hex.EncodeToString(serverSeed[:]), clientSeed)
+	if err != nil {
+		return SeedPair{}, err
+	}
+	return db.SeedPairGetActive(sp.UserId)
+}
+
+func (db Queries) DepositCreate(id string, userId string, url string, amountCents uint64, expiresAt uint64) error {
+	_, err := db.Exec(`INSERT INTO deposits (id, userId, url, amountCents, expiresAt) VALUES (?, ?, ?, ?, ?)`,
+		id, userId, url, amountCents, expiresAt)
 	return err
 }
 
-func (db Database) DepositGet(id string) (Deposit, error) {
+const DEPOSIT_COLUMNS = `id, userId, url, amountCents, completed, signature, expired, createdAt, expiresAt, completedAt`
+
+// Scans a deposit from `row`, which must select DEPOSIT_COLUMNS
+func depositScan(row interface{ Scan(...any) error }) (Deposit, error) {
 	var deposit Deposit
 	var signature sql.NullString
 	var completedAt sql.NullInt64
-
-	err := db.QueryRow(`SELECT id, userId, url, amountCents, completed, signature, createdAt, completedAt
-                        FROM deposits WHERE id = ?`, id).Scan(
-		&deposit.Id, &deposit.UserId, &deposit.Url, &deposit.AmountCents, &deposit.Completed,
-		&signature, &deposit.CreatedAt, &completedAt)
-
+	err := row.Scan(&deposit.Id, &deposit.UserId, &deposit.Url, &deposit.AmountCents, &deposit.Completed,
+		&signature, &deposit.Expired, &deposit.CreatedAt, &deposit.ExpiresAt, &completedAt)
 	if signature.Valid {
 		deposit.Signature = signature.String
 	}
@@ -208,28 +750,54 @@ func (db Database) DepositGet(id string) (Deposit, error) {
 		completedAt := uint64(completedAt.Int64)
 		deposit.CompletedAt = &completedAt
 	}
-
 	return deposit, err
 }
 
-func (db Database) DepositUncomplete(id string) error {
-	result, err := db.Exec(`UPDATE deposits SET completed = 0 WHERE id = ?`, id)
+// Runs a query selecting DEPOSIT_COLUMNS, and collects the results
+func (db Queries) depositQuery(query string, args ...any) ([]Deposit, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deposits := []Deposit{}
+	for rows.Next() {
+		deposit, err := depositScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, deposit)
+	}
+
+	return deposits, nil
+}
+
+func (db Queries) DepositGet(id string) (Deposit, error) {
+	return depositScan(db.QueryRow(`SELECT `+DEPOSIT_COLUMNS+` FROM deposits WHERE id = ?`, id))
+}
+
+// Completes a deposit. Expired deposits can still be completed,
+// so that a payment which lands after expiry is never lost.
+func (db Queries) DepositComplete(id string, signature string, timestamp uint64) error {
+	result, err := db.Exec(`UPDATE deposits SET completed = 1, expired = 0, signature = ?, completedAt = ?
+                            WHERE id = ? AND completed = 0`, signature, timestamp, id)
 	if err != nil {
 		return err
 	}
-	aff, err := result.RowsAffected()
+	affected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-	if aff < 1 {
-		return errors.New("could not uncomplete deposit: can't find provided ID in db")
+	if affected < 1 {
+		return errors.New("deposit not found or already completed")
 	}
 	return nil
 }
 
-func (db Database) DepositComplete(id string, signature string, timestamp uint64) error {
-	result, err := db.Exec(`UPDATE deposits SET completed = 1, signature = ?, completedAt = ?
-                            WHERE id = ? AND completed = 0`, signature, timestamp, id)
+// Marks a pending deposit as expired
+func (db Queries) DepositExpire(id string) error {
+	result, err := db.Exec(`UPDATE deposits SET expired = 1 WHERE id = ? AND completed = 0 AND expired = 0`, id)
 	if err != nil {
 		return err
 	}
@@ -238,108 +806,406 @@ func (db Database) DepositComplete(id string, signature string, timestamp uint64
 		return err
 	}
 	if affected < 1 {
-		return errors.New("deposit not found or already completed")
+		return errors.New("deposit not found, already completed or already expired")
 	}
 	return nil
 }
 
-func (db Database) DepositList(userId string, count int, skip int) ([]Deposit, error) {
-	rows, err := db.Query(`SELECT id, userId, url, amountCents, completed, signature, createdAt, completedAt
-                          FROM deposits WHERE userId = ? ORDER BY createdAt DESC LIMIT ? OFFSET ?`,
+// Lists pending deposits that are due to be checked at `now`,
+// those that have waited the longest first
+func (db Queries) DepositListDue(now uint64, limit int) ([]Deposit, error) {
+	return db.depositQuery(`SELECT `+DEPOSIT_COLUMNS+` FROM deposits
+                            WHERE completed = 0 AND expired = 0 AND checkAt <= ? ORDER BY checkAt, createdAt LIMIT ?`,
+		now, limit)
+}
+
+// Schedules the next check of a pending deposit, doubling the
+// delay since the last one, between `minDelay` and `maxDelay`
+func (db Queries) DepositBackOff(id string, now uint64, minDelay time.Duration, maxDelay time.Duration) error {
+	// the right-hand sides all see the old `checkDelay`
+	_, err := db.Exec(`UPDATE deposits SET checkDelay = MIN(MAX(checkDelay * 2, ?1), ?2),
+                       checkAt = ?3 + MIN(MAX(checkDelay * 2, ?1), ?2) WHERE id = ?4`,
+		int64(minDelay.Seconds()), int64(maxDelay.Seconds()), now, id)
+	return err
+}
+
+// Lists pending deposits whose intent expired before `now`
+func (db Queries) DepositListExpired(now uint64, limit int) ([]Deposit, error) {
+	return db.depositQuery(`SELECT `+DEPOSIT_COLUMNS+` FROM deposits
+                            WHERE completed = 0 AND expired = 0 AND expiresAt <= ? ORDER BY expiresAt LIMIT ?`,
+		now, limit)
+}
+
+func (db Queries) DepositList(userId string, count int, skip int) ([]Deposit, error) {
+	return db.depositQuery(`SELECT `+DEPOSIT_COLUMNS+` FROM deposits
+                            WHERE userId = ? ORDER BY createdAt DESC LIMIT ? OFFSET ?`,
 		userId, count, skip)
+}
+
+func (db Queries) WithdrawCreate(id string, userId string, url string, amountCents uint64, signature string, expiresAt uint64) error {
+	_, err := db.Exec(`INSERT INTO withdrawals (id, userId, url, amountCents, signature, expiresAt) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, userId, url, amountCents, signature, expiresAt)
+	return err
+}
+
+const WITHDRAWAL_COLUMNS = `id, userId, url, amountCents, signature, completed, claimSignature, expired, createdAt, expiresAt, completedAt`
+
+// Scans a withdrawal from `row`, which must select WITHDRAWAL_COLUMNS
+func withdrawalScan(row interface{ Scan(...any) error }) (Withdrawal, error) {
+	var withdrawal Withdrawal
+	var claimSignature sql.NullString
+	var completedAt sql.NullInt64
+	err := row.Scan(&withdrawal.Id, &withdrawal.UserId, &withdrawal.Url, &withdrawal.AmountCents,
+		&withdrawal.Signature, &withdrawal.Completed, &claimSignature, &withdrawal.Expired,
+		&withdrawal.CreatedAt, &withdrawal.ExpiresAt, &completedAt)
+	if claimSignature.Valid {
+		withdrawal.ClaimSignature = claimSignature.String
+	}
+	if completedAt.Valid {
+		completedAt := uint64(completedAt.Int64)
+		withdrawal.CompletedAt = &completedAt
+	}
+	return withdrawal, err
+}
+
+func (db Queries) WithdrawGet(id string) (Withdrawal, error) {
+	return withdrawalScan(db.QueryRow(`SELECT `+WITHDRAWAL_COLUMNS+` FROM withdrawals WHERE id = ?`, id))
+}
+
+// Marks a withdrawal as claimed on-chain
+func (db Queries) WithdrawComplete(id string, claimSignature string, timestamp uint64) error {
+	result, err := db.Exec(`UPDATE withdrawals SET completed = 1, claimSignature = ?, completedAt = ?
+                            WHERE id = ? AND completed = 0`, claimSignature, timestamp, id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected < 1 {
+		return errors.New("withdrawal not found or already completed")
+	}
+	return nil
+}
+
+// Marks an unclaimed withdrawal as expired, and forgets its URL and signature
+// so that we never hand them out again. The caller is responsible for refunding it.
+func (db Queries) WithdrawExpire(id string) error {
+	result, err := db.Exec(`UPDATE withdrawals SET expired = 1, url = '', signature = ''
+                            WHERE id = ? AND completed = 0 AND expired = 0`, id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected < 1 {
+		return errors.New("withdrawal not found, already completed or already expired")
+	}
+	return nil
+}
+
+// Lists unclaimed withdrawals whose claim window closed before `now`
+func (db Queries) WithdrawListExpired(now uint64, limit int) ([]Withdrawal, error) {
+	return db.withdrawalQuery(`SELECT `+WITHDRAWAL_COLUMNS+` FROM withdrawals
+                               WHERE completed = 0 AND expired = 0 AND expiresAt <= ? ORDER BY expiresAt LIMIT ?`,
+		now, limit)
+}
+
+// Lists expired withdrawals that haven't been claimed, least recently checked first
+func (db Queries) WithdrawListRefunded(limit int) ([]Withdrawal, error) {
+	return db.withdrawalQuery(`SELECT `+WITHDRAWAL_COLUMNS+` FROM withdrawals
+                               WHERE completed = 0 AND expired = 1 ORDER BY checkedAt LIMIT ?`,
+		limit)
+}
+
+// Records when an expired withdrawal was last checked for a late claim
+func (db Queries) WithdrawSetChecked(id string, checkedAt uint64) error {
+	_, err := db.Exec(`UPDATE withdrawals SET checkedAt = ? WHERE id = ?`, checkedAt, id)
+	return err
+}
+
+func (db Queries) withdrawalQuery(query string, args ...any) ([]Withdrawal, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var deposits []Deposit
+	withdrawals := []Withdrawal{}
 	for rows.Next() {
-		var deposit Deposit
-		var signature sql.NullString
-		var completedAt sql.NullInt64
-
-		err := rows.Scan(&deposit.Id, &deposit.UserId, &deposit.Url, &deposit.AmountCents, &deposit.Completed,
-			&signature, &deposit.CreatedAt, &completedAt)
+		withdrawal, err := withdrawalScan(rows)
 		if err != nil {
 			return nil, err
 		}
+		withdrawals = append(withdrawals, withdrawal)
+	}
 
-		if signature.Valid {
-			deposit.Signature = signature.String
-		}
-		if completedAt.Valid {
-			completedAt := uint64(completedAt.Int64)
-			deposit.CompletedAt = &completedAt
+	return withdrawals, nil
+}
+
+func (db Queries) WithdrawList(userId string, limit int, offset int) ([]Withdrawal, error) {
+	rows, err := db.Query(`SELECT `+WITHDRAWAL_COLUMNS+` FROM withdrawals
+                          WHERE userId = ? ORDER BY createdAt DESC LIMIT ? OFFSET ?`,
+		userId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	withdrawals := []Withdrawal{}
+	for rows.Next() {
+		withdrawal, err := withdrawalScan(rows)
+		if err != nil {
+			return nil, err
 		}
 
-		deposits = append(deposits, deposit)
+		withdrawals = append(withdrawals, withdrawal)
 	}
 
-	return deposits, nil
+	return withdrawals, nil
 }
 
-func (db Database) WithdrawCreate(id string, userId string, url string, amountCents uint64, signature string) error {
-	_, err := db.Exec(`INSERT INTO withdrawals (id, userId, url, amountCents, signature) VALUES (?, ?, ?, ?, ?)`,
-		id, userId, url, amountCents, signature)
+func (db Queries) UserSetAuthNotBefore(id string, notBefore uint64) error {
+	_, err := db.Exec(`UPDATE users SET authNotBefore = ? WHERE id = ?`, notBefore, id)
 	return err
 }
 
-func (db Database) WithdrawGet(id string) (Withdrawal, error) {
-	var withdrawal Withdrawal
+// Returns the `authNotBefore` of every user who has one
+func (db Queries) UserListAuthNotBefore() (map[string]uint64, error) {
+	rows, err := db.Query(`SELECT id, authNotBefore FROM users WHERE authNotBefore > 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notBefore := make(map[string]uint64)
+	for rows.Next() {
+		var id string
+		var t uint64
+		err := rows.Scan(&id, &t)
+		if err != nil {
+			return nil, err
+		}
+		notBefore[id] = t
+	}
 
-	err := db.QueryRow(`SELECT id, userId, url, amountCents, signature, createdAt
-                        FROM withdrawals WHERE id = ?`, id).Scan(
-		&withdrawal.Id, &withdrawal.UserId, &withdrawal.Url, &withdrawal.AmountCents,
-		&withdrawal.Signature, &withdrawal.CreatedAt)
+	return notBefore, rows.Err()
+}
 
-	return withdrawal, err
+const API_KEY_COLUMNS = `id, userId, name, prefix, scopes, maxWagerCents, revoked, createdAt, expiresAt`
+
+func apiKeyScan(row interface{ Scan(...any) error }) (ApiKey, error) {
+	var k ApiKey
+	var scopes string
+	err := row.Scan(&k.Id, &k.UserId, &k.Name, &k.Prefix, &scopes, &k.MaxWagerCents, &k.Revoked, &k.CreatedAt, &k.ExpiresAt)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	k.Scopes = []string{}
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	return k, nil
 }
 
-func (db Database) WithdrawList(userId string, limit int, offset int) ([]Withdrawal, error) {
-	rows, err := db.Query(`SELECT id, userId, url, amountCents, signature, createdAt
-                          FROM withdrawals WHERE userId = ? ORDER BY createdAt DESC LIMIT ? OFFSET ?`,
-		userId, limit, offset)
+// Records a new API key, given the hash of the key itself, returning its ID
+func (db Queries) ApiKeyCreate(k ApiKey, keyHash string) (uint64, error) {
+	result, err := db.Exec(`INSERT INTO api_keys (userId, keyHash, name, prefix, scopes, maxWagerCents, createdAt, expiresAt)
+                            VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.UserId, keyHash, k.Name, k.Prefix, strings.Join(k.Scopes, ","), k.MaxWagerCents, k.CreatedAt, k.ExpiresAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return uint64(id), err
+}
+
+func (db Queries) ApiKeyGetByHash(keyHash string) (ApiKey, error) {
+	return apiKeyScan(db.QueryRow(`SELECT `+API_KEY_COLUMNS+` FROM api_keys WHERE keyHash = ?`, keyHash))
+}
+
+// Lists all of the user's API keys, newest first
+func (db Queries) ApiKeyList(userId string) ([]ApiKey, error) {
+	rows, err := db.Query(`SELECT `+API_KEY_COLUMNS+` FROM api_keys WHERE userId = ? ORDER BY id DESC`, userId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var withdrawals []Withdrawal
+	keys := []ApiKey{}
 	for rows.Next() {
-		var withdrawal Withdrawal
-		err := rows.Scan(&withdrawal.Id, &withdrawal.UserId, &withdrawal.Url, &withdrawal.AmountCents,
-			&withdrawal.Signature, &withdrawal.CreatedAt)
+		k, err := apiKeyScan(rows)
 		if err != nil {
 			return nil, err
 		}
+		keys = append(keys, k)
+	}
 
-		withdrawals = append(withdrawals, withdrawal)
+	return keys, rows.Err()
+}
+
+func (db Queries) ApiKeyRevoke(userId string, id uint64) error {
+	result, err := db.Exec(`UPDATE api_keys SET revoked = 1 WHERE id = ? AND userId = ?`, id, userId)
+	if err != nil {
+		return err
 	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return NewError(CODE_NOT_FOUND, "API key not found")
+	}
+	return nil
+}
 
-	return withdrawals, nil
+// Revokes every API key `userId` created before `createdBefore`
+func (db Queries) ApiKeyRevokeAll(userId string, createdBefore uint64) error {
+	_, err := db.Exec(`UPDATE api_keys SET revoked = 1 WHERE userId = ? AND createdAt < ?`, userId, createdBefore)
+	return err
+}
+
+// Returns the revoked sessions that haven't expired yet, mapped to their expiry
+func (db Queries) SessionListRevoked(now uint64) (map[string]uint64, error) {
+	rows, err := db.Query(`SELECT id, expiresAt FROM revoked_sessions WHERE expiresAt > ?`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := make(map[string]uint64)
+	for rows.Next() {
+		var id string
+		var expiresAt uint64
+		err := rows.Scan(&id, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		revoked[id] = expiresAt
+	}
+
+	return revoked, rows.Err()
 }
 
-func (db Database) BetCreate(b Bet) error {
-	_, err := db.Exec(`INSERT INTO bets (userId, amountCents, rollUnder, threshold, result, won, serverSeed)
-                       VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		b.UserId, b.AmountCents, b.RollUnder, b.Threshold, b.Result, b.Won, b.ServerSeed)
+func (db Queries) SessionRevoke(id string, expiresAt uint64) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO revoked_sessions (id, expiresAt) VALUES (?, ?)`, id, expiresAt)
 	return err
 }
 
-func (db Database) BetList(userId string, count int, skip int) ([]Bet, error) {
-	rows, err := db.Query(`SELECT id, userId, amountCents, rollUnder, threshold, result, won, serverSeed, createdAt
-                          FROM bets WHERE userId = ? ORDER BY createdAt DESC LIMIT ? OFFSET ?`,
+// Deletes revoked sessions that have expired anyway
+func (db Queries) SessionPruneRevoked(now uint64) error {
+	_, err := db.Exec(`DELETE FROM revoked_sessions WHERE expiresAt <= ?`, now)
+	return err
+}
+
+// Returns the latest version of the game parameters, or
+// `sql.ErrNoRows` if they've never been recorded
+func (db Queries) GameParamsLatest() (GameParams, error) {
+	var gp GameParams
+	var params string
+	err := db.QueryRow(`SELECT version, params FROM game_params ORDER BY version DESC LIMIT 1`).Scan(&gp.Version, &params)
+	if err != nil {
+		return GameParams{}, err
+	}
+	err = json.Unmarshal([]byte(params), &gp.GameConfig)
+	if err != nil {
+		return GameParams{}, fmt.Errorf("can't decode game params version %d: %v", gp.Version, err)
+	}
+	return gp, nil
+}
+
+// Records a new version of the game parameters
+func (db Queries) GameParamsCreate(g GameConfig) (GameParams, error) {
+	params, err := json.Marshal(g)
+	if err != nil {
+		return GameParams{}, err
+	}
+	result, err := db.Exec(`INSERT INTO game_params (params) VALUES (?)`, string(params))
+	if err != nil {
+		return GameParams{}, err
+	}
+	version, err := result.LastInsertId()
+	if err != nil {
+		return GameParams{}, err
+	}
+	return GameParams{
+		GameConfig: g,
+		Version:    uint64(version),
+	}, nil
+}
+
+// Records a bet, returning its ID
+func (db Queries) BetCreate(b Bet) (uint64, error) {
+	result, err := db.Exec(`INSERT INTO bets (userId, amountCents, rollUnder, threshold, result, won, seedPairId, serverSeed, clientSeed, nonce, algorithmVersion, houseEdgePct, paramsVersion)
+                       VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.UserId, b.AmountCents, b.RollUnder, b.Threshold, b.Result, b.Won, b.SeedPairId, b.ServerSeed, b.ClientSeed, b.Nonce, b.AlgorithmVersion, b.HouseEdgePct, b.ParamsVersion)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return uint64(id), err
+}
+
+// Calls `f` for every bet ever made, in order. Only the
+// fields needed to settle the bet are filled in.
+func (db Queries) BetForEach(f func(b Bet) error) error {
+	rows, err := db.Query(`SELECT id, userId, amountCents, rollUnder, threshold, result, won, houseEdgePct FROM bets ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bet Bet
+		err := rows.Scan(&bet.Id, &bet.UserId, &bet.AmountCents, &bet.RollUnder,
+			&bet.Threshold, &bet.Result, &bet.Won, &bet.HouseEdgePct)
+		if err != nil {
+			return err
+		}
+		err = f(bet)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Lists the user's bets. The server seed of bets
+// whose seed pair is still active is withheld.
+func (db Queries) BetList(userId string, count int, skip int) ([]Bet, error) {
+	return db.betList(`WHERE b.userId = ? ORDER BY b.createdAt DESC, b.id DESC LIMIT ? OFFSET ?`,
 		userId, count, skip)
+}
+
+// Lists the user's bets with an ID below `beforeId`, newest first. Unlike
+// `BetList`, pages don't shift as new bets are placed.
+func (db Queries) BetListBefore(userId string, beforeId uint64, count int) ([]Bet, error) {
+	return db.betList(`WHERE b.userId = ? AND b.id < ? ORDER BY b.id DESC LIMIT ?`,
+		userId, beforeId, count)
+}
+
+func (db Queries) betList(where string, args ...any) ([]Bet, error) {
+	rows, err := db.Query(`SELECT b.id, b.userId, b.amountCents, b.rollUnder, b.threshold, b.result, b.won,
+                                  COALESCE(b.seedPairId, 0),
+                                  CASE WHEN sp.active = 1 THEN '' ELSE b.serverSeed END,
+                                  b.clientSeed, b.nonce, b.algorithmVersion, b.houseEdgePct, b.paramsVersion, b.createdAt
+                          FROM bets b LEFT JOIN seed_pairs sp ON sp.id = b.seedPairId
+                          `+where, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var bets []Bet
+	bets := []Bet{}
 	for rows.Next() {
 		var bet Bet
 		err := rows.Scan(&bet.Id, &bet.UserId, &bet.AmountCents, &bet.RollUnder,
-			&bet.Threshold, &bet.Result, &bet.Won, &bet.ServerSeed, &bet.CreatedAt)
+			&bet.Threshold, &bet.Result, &bet.Won, &bet.SeedPairId, &bet.ServerSeed,
+			&bet.ClientSeed, &bet.Nonce, &bet.AlgorithmVersion, &bet.HouseEdgePct, &bet.ParamsVersion, &bet.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Waiters for deposits to complete or expire, keyed by deposit ID.
+// `completeDeposit` publishes here, so every way of completing a deposit
+// (`deposit_status`, the watcher, the webhook) wakes them up, and so
+// does `sweepDeposits` when it expires one.
+type DepositEvents struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan Deposit]struct{}
+}
+
+func NewDepositEvents() *DepositEvents {
+	return &DepositEvents{
+		waiters: make(map[string]map[chan Deposit]struct{}),
+	}
+}
+
+// Returns a channel that receives the deposit once it completes or
+// expires, and a function to stop waiting, which must be called
+func (d *DepositEvents) Subscribe(id string) (chan Deposit, func()) {
+	// waiters stop at the first update, so one slot is enough to never block
+	ch := make(chan Deposit, 1)
+	d.mu.Lock()
+	if d.waiters[id] == nil {
+		d.waiters[id] = make(map[chan Deposit]struct{})
+	}
+	d.waiters[id][ch] = struct{}{}
+	d.mu.Unlock()
+	return ch, func() {
+		d.mu.Lock()
+		delete(d.waiters[id], ch)
+		if len(d.waiters[id]) == 0 {
+			delete(d.waiters, id)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// Wakes up everyone waiting for `deposit`, which has just completed or expired
+func (d *DepositEvents) Publish(deposit Deposit) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.waiters[deposit.Id] {
+		select {
+		case ch <- deposit:
+		default:
+		}
+	}
+}
+
+// Serves `GET /v1/deposits/{id}/events`, a Server-Sent Events stream of
+// the deposit. It starts with a `deposit` event holding its current state,
+// and if that isn't completed or expired, sends another once it is, then
+// ends. It also ends after `DEPOSIT_EVENTS_MAX_DURATION`, for the client
+// to reconnect.
+func (d *DepositEvents) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		restHeaders(w)
+		w.Header().Set("Cache-Control", "private")
+		w.Header().Set("Vary", "Authorization, "+REST_MESSAGE_HEADER+", "+REST_SIGNATURE_HEADER)
+
+		// (1) Authenticate + check the deposit is theirs, just like `deposit_status`
+		id := r.PathValue("id")
+		userId, err := Authenticate(restAuth(r), SCOPE_READ)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		// subscribe first, so we can't miss a completion that
+		// happens between reading the deposit and waiting
+		updates, unsubscribe := d.Subscribe(id)
+		defer unsubscribe()
+		deposit, err := DB.DepositGet(id)
+		if err == sql.ErrNoRows {
+			writeError(w, NewError(CODE_NOT_FOUND, "deposit not found"))
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if deposit.UserId != userId {
+			writeError(w, NewError(CODE_FORBIDDEN, "deposit not owned by authenticated user"))
+			return
+		}
+
+		// (2) Send the current state
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, NewError(CODE_INTERNAL, "streaming is not supported"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // don't let nginx buffer the stream
+		w.WriteHeader(http.StatusOK)
+		writeEvent(w, "deposit", deposit)
+		flusher.Flush()
+		if deposit.Completed || deposit.Expired {
+			return
+		}
+
+		// (3) Wait for it to complete or expire
+		heartbeat := time.NewTicker(DEPOSIT_EVENTS_HEARTBEAT_INTERVAL)
+		defer heartbeat.Stop()
+		deadline := time.NewTimer(DEPOSIT_EVENTS_MAX_DURATION)
+		defer deadline.Stop()
+		for {
+			select {
+			case deposit := <-updates:
+				writeEvent(w, "deposit", deposit)
+				flusher.Flush()
+				return
+			case <-heartbeat.C:
+				// a comment, to keep proxies from timing out the connection
+				w.Write([]byte(": heartbeat\n\n"))
+				flusher.Flush()
+			case <-deadline.C:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// Writes a Server-Sent Event, with `data` encoded as JSON
+func writeEvent(w http.ResponseWriter, event string, data any) {
+	text, err := json.Marshal(data)
+	if err != nil {
+		text = []byte(`{"error":"can't serialize event"}`)
+	}
+	w.Write([]byte("event: " + event + "\ndata: " + string(text) + "\n\n"))
+}
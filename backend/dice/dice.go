@@ -0,0 +1,139 @@
+// Package dice contains the provably-fair roll and payout math,
+// shared between the backend and the offline verifier.
+package dice
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Roll algorithm versions. Every bet records the version it was
+// rolled with, so that old bets keep verifying after an upgrade.
+const (
+	// Bets from before seed pairs, rolled from SHA-256(serverSeed || clientSeed)
+	// with a client seed that wasn't recorded. They can't be verified.
+	AlgorithmLegacy = 0
+	// SHA-256("serverSeed:clientSeed:nonce") mod 10,000
+	AlgorithmV1 = 1
+	// HMAC-SHA256 keyed by the server seed, with rejection sampling
+	AlgorithmV2 = 2
+	// The version used for new bets
+	AlgorithmLatest = AlgorithmV2
+	// The version of bets that don't say which one they were rolled
+	// with: v1 was the only one before bets recorded their version
+	AlgorithmUnrecorded = AlgorithmV1
+)
+
+// Returned by `Roll` for bets rolled with `AlgorithmLegacy`
+var ErrUnverifiable = errors.New("bets from before seed pairs can't be verified, as their client seed wasn't recorded")
+
+// Roll returns a random integer in the range [0, 10000) using
+// the given algorithm version. serverSeed is hex-encoded.
+func Roll(version uint8, serverSeed string, clientSeed string, nonce uint64) (uint16, error) {
+	switch version {
+	case AlgorithmLegacy:
+		return 0, ErrUnverifiable
+	case AlgorithmV1:
+		return rollV1(serverSeed, clientSeed, nonce), nil
+	case AlgorithmV2:
+		return rollV2(serverSeed, clientSeed, nonce), nil
+	default:
+		return 0, fmt.Errorf("unknown roll algorithm version %d", version)
+	}
+}
+
+// rollV1 derives the roll from SHA-256("serverSeed:clientSeed:nonce"),
+// where nonce is written in decimal.
+func rollV1(serverSeed string, clientSeed string, nonce uint64) uint16 {
+	// hash server seed, client seed and nonce together
+	hash := sha256.Sum256([]byte(serverSeed + ":" + clientSeed + ":" + strconv.FormatUint(nonce, 10)))
+	// get random 64-bit integer
+	n := binary.LittleEndian.Uint64(hash[:8])
+	// convert it to range by taking it mod 10,000
+	// (This results in a very, very small
+	// bias towards small numbers: we will produce
+	// an unfair result with probability ((2**64)%10000)/(2**64),
+	// or 8.760353553682876e-17. This is satisfactory for our
+	// use case)
+	return uint16(n % 10_000)
+}
+
+// The largest multiple of 10,000 that fits in a uint32. Values at
+// or above it are rejected, so that `n % 10_000` is exactly uniform.
+const rejectionLimit = (1 << 32) / 10_000 * 10_000
+
+// rollV2 derives the roll from HMAC-SHA256(serverSeed, "clientSeed:nonce:round"),
+// where round starts at 0. Each digest is read as 8 little-endian 4-byte
+// chunks; the first chunk below `rejectionLimit` is reduced mod 10,000.
+// If all 8 are rejected (probability ~1e-42), round is incremented.
+func rollV2(serverSeed string, clientSeed string, nonce uint64) uint16 {
+	prefix := clientSeed + ":" + strconv.FormatUint(nonce, 10) + ":"
+	for round := uint64(0); ; round++ {
+		mac := hmac.New(sha256.New, []byte(serverSeed))
+		mac.Write([]byte(prefix + strconv.FormatUint(round, 10)))
+		digest := mac.Sum(nil)
+		for i := 0; i+4 <= len(digest); i += 4 {
+			n := binary.LittleEndian.Uint32(digest[i : i+4])
+			if n < rejectionLimit {
+				return uint16(n % 10_000)
+			}
+		}
+	}
+}
+
+// Returns the hex-encoded SHA-256 hash of the hex-encoded server seed,
+// which is the commitment shown to the user before the seed is revealed.
+func HashServerSeed(serverSeed string) (string, error) {
+	ss, err := hex.DecodeString(serverSeed)
+	if err != nil || len(ss) != 32 {
+		return "", errors.New("error decoding server seed")
+	}
+	ssHash := sha256.Sum256(ss)
+	return hex.EncodeToString(ssHash[:]), nil
+}
+
+// The outcome of a single bet
+type Outcome struct {
+	Won         bool
+	PayoutCents uint64 // total amount paid back to the player, 0 if lost
+	DeltaCents  int64  // change in the player's balance
+}
+
+// Won reports whether `roll` wins a bet on rolling under (or over) `threshold`.
+func Won(rollUnder bool, threshold uint16, roll uint16) bool {
+	if rollUnder {
+		return roll < threshold
+	}
+	return roll > threshold
+}
+
+// Settle computes the outcome of a bet of `wagerCents` on rolling
+// under (or over) `threshold`, given the rolled value and house edge.
+func Settle(wagerCents uint64, rollUnder bool, threshold uint16, roll uint16, houseEdgePct uint64) Outcome {
+	if !Won(rollUnder, threshold, roll) {
+		return Outcome{
+			Won:         false,
+			PayoutCents: 0,
+			DeltaCents:  -int64(wagerCents),
+		}
+	}
+	var underAmountCents uint64
+	if rollUnder {
+		underAmountCents = uint64(threshold)
+	} else {
+		underAmountCents = 10000 - uint64(threshold)
+	}
+	// reward = wager * (10000 / underAmountCents) - wager
+	// Apply house edge
+	payout := (wagerCents * 10000 * (100 - houseEdgePct)) / (underAmountCents * 100)
+	return Outcome{
+		Won:         true,
+		PayoutCents: payout,
+		DeltaCents:  int64(payout) - int64(wagerCents),
+	}
+}
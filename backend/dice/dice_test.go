@@ -0,0 +1,105 @@
+package dice
+
+import (
+	"errors"
+	"testing"
+)
+
+// Rolls recorded in the database must keep verifying, so these pin each
+// algorithm to known answers, computed independently of this package.
+const testServerSeed = "3729039ae422e476f7ebd9ad369b2485c4052a107846c7c3fd2413a2ba44ebe9"
+
+func TestRollKnownAnswers(t *testing.T) {
+	tests := []struct {
+		version    uint8
+		clientSeed string
+		nonce      uint64
+		roll       uint16
+	}{
+		{AlgorithmV1, "client", 0, 7615},
+		{AlgorithmV1, "client", 1, 3116},
+		{AlgorithmV1, "fbbc8b29ab819105", 42, 1704},
+		{AlgorithmV1, "", 18446744073709551615, 3319},
+		{AlgorithmV2, "client", 0, 10},
+		{AlgorithmV2, "client", 1, 500},
+		{AlgorithmV2, "fbbc8b29ab819105", 42, 7728},
+		{AlgorithmV2, "", 18446744073709551615, 5830},
+		// the first chunk of this digest is 4294965479, which is at
+		// or above `rejectionLimit`, so the second one is used
+		{AlgorithmV2, "client", 122499, 6520},
+	}
+	for _, tt := range tests {
+		roll, err := Roll(tt.version, testServerSeed, tt.clientSeed, tt.nonce)
+		if err != nil {
+			t.Fatalf("v%d %q %d: %v", tt.version, tt.clientSeed, tt.nonce, err)
+		}
+		if roll != tt.roll {
+			t.Errorf("v%d %q %d: rolled %d, want %d", tt.version, tt.clientSeed, tt.nonce, roll, tt.roll)
+		}
+	}
+}
+
+func TestRollRange(t *testing.T) {
+	for _, version := range []uint8{AlgorithmV1, AlgorithmV2} {
+		for nonce := range uint64(10_000) {
+			roll, err := Roll(version, testServerSeed, "client", nonce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if roll >= 10_000 {
+				t.Fatalf("v%d nonce %d: rolled %d", version, nonce, roll)
+			}
+		}
+	}
+}
+
+func TestRollRefusesUnverifiableVersions(t *testing.T) {
+	_, err := Roll(AlgorithmLegacy, testServerSeed, "client", 0)
+	if !errors.Is(err, ErrUnverifiable) {
+		t.Fatalf("legacy bets should be unverifiable, got %v", err)
+	}
+	_, err = Roll(AlgorithmLatest+1, testServerSeed, "client", 0)
+	if err == nil {
+		t.Fatal("rolled with an unknown version")
+	}
+}
+
+func TestHashServerSeed(t *testing.T) {
+	hash, err := HashServerSeed(testServerSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != "ce255d5c734ed6f5629503fb26a6c77824bbfb611cec75d5e21b8a76ce702613" {
+		t.Fatalf("got hash %s", hash)
+	}
+	_, err = HashServerSeed("abcd")
+	if err == nil {
+		t.Fatal("hashed a seed that's too short")
+	}
+}
+
+func TestSettle(t *testing.T) {
+	tests := []struct {
+		name         string
+		wagerCents   uint64
+		rollUnder    bool
+		threshold    uint16
+		roll         uint16
+		houseEdgePct uint64
+		want         Outcome
+	}{
+		{"lowest roll-under", 100, true, 1, 0, 1, Outcome{true, 990000, 989900}},
+		{"roll equal to roll-under threshold", 100, true, 1, 1, 1, Outcome{false, 0, -100}},
+		{"highest roll-under", 10000, true, 9802, 9801, 1, Outcome{true, 10099, 99}},
+		{"highest roll-over", 10000, false, 9899, 9999, 1, Outcome{true, 980198, 970198}},
+		{"roll equal to roll-over threshold", 10000, false, 9899, 9899, 1, Outcome{false, 0, -10000}},
+		{"roll-over 0 with an edge pays less than the wager", 100, false, 0, 1, 1, Outcome{true, 99, -1}},
+		{"largest wager doesn't overflow", 18446744073709, true, 9999, 0, 0, Outcome{true, 18448588932602, 1844858893}},
+	}
+	for _, tt := range tests {
+		got := Settle(tt.wagerCents, tt.rollUnder, tt.threshold, tt.roll, tt.houseEdgePct)
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A stable, machine-readable error code. Clients should match on these
+// rather than on error messages, which may change.
+type ErrorCode string
+
+const (
+	CODE_INVALID_REQUEST        ErrorCode = "INVALID_REQUEST"
+	CODE_UNKNOWN_ACTION         ErrorCode = "UNKNOWN_ACTION"
+	CODE_METHOD_NOT_ALLOWED     ErrorCode = "METHOD_NOT_ALLOWED"
+	CODE_NOT_FOUND              ErrorCode = "NOT_FOUND"
+	CODE_AUTH_REQUIRED          ErrorCode = "AUTH_REQUIRED"
+	CODE_AUTH_INVALID           ErrorCode = "AUTH_INVALID"
+	CODE_AUTH_EXPIRED           ErrorCode = "AUTH_EXPIRED"
+	CODE_FORBIDDEN              ErrorCode = "FORBIDDEN"
+	CODE_ACCOUNT_FROZEN         ErrorCode = "ACCOUNT_FROZEN"
+	CODE_INSUFFICIENT_BALANCE   ErrorCode = "INSUFFICIENT_BALANCE"
+	CODE_WAGER_OUT_OF_RANGE     ErrorCode = "WAGER_OUT_OF_RANGE"
+	CODE_THRESHOLD_OUT_OF_RANGE ErrorCode = "THRESHOLD_OUT_OF_RANGE"
+	CODE_INVALID_CLIENT_SEED    ErrorCode = "INVALID_CLIENT_SEED"
+	CODE_CAS_CONFLICT           ErrorCode = "CAS_CONFLICT" // lost a race with a concurrent request: safe to retry
+	CODE_UPSTREAM_ERROR         ErrorCode = "UPSTREAM_ERROR"
+	CODE_UPSTREAM_UNAVAILABLE   ErrorCode = "UPSTREAM_UNAVAILABLE" // the aggregator is down: retry later
+	CODE_INTERNAL               ErrorCode = "INTERNAL"
+)
+
+// The HTTP status of each error code
+var ERROR_STATUSES = map[ErrorCode]int{
+	CODE_INVALID_REQUEST:        400,
+	CODE_UNKNOWN_ACTION:         400,
+	CODE_METHOD_NOT_ALLOWED:     405,
+	CODE_NOT_FOUND:              404,
+	CODE_AUTH_REQUIRED:          401,
+	CODE_AUTH_INVALID:           401,
+	CODE_AUTH_EXPIRED:           401,
+	CODE_FORBIDDEN:              403,
+	CODE_ACCOUNT_FROZEN:         403,
+	CODE_INSUFFICIENT_BALANCE:   422,
+	CODE_WAGER_OUT_OF_RANGE:     422,
+	CODE_THRESHOLD_OUT_OF_RANGE: 422,
+	CODE_INVALID_CLIENT_SEED:    422,
+	CODE_CAS_CONFLICT:           409,
+	CODE_UPSTREAM_ERROR:         502,
+	CODE_UPSTREAM_UNAVAILABLE:   503,
+	CODE_INTERNAL:               500,
+}
+
+// An error that's meant for the user: its message and details are
+// returned as-is. Any other error is reported as `CODE_INTERNAL`,
+// without its message, since it may contain SQL or other internals.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details map[string]any // optional: e.g. the allowed range of a parameter
+}
+
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func Errorf(code ErrorCode, format string, args ...any) *Error {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Status() int {
+	status, ok := ERROR_STATUSES[e.Code]
+	if !ok {
+		return 500
+	}
+	return status
+}
+
+type ErrorResponse struct {
+	Error   string         `json:"error"`
+	Code    ErrorCode      `json:"code"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Converts any error into one that's safe to show to the user,
+// logging the ones we can't explain
+func ToUserError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var ae *AggregatorError
+	if errors.As(err, &ae) {
+		return Errorf(CODE_UPSTREAM_ERROR, "aggregator error: %s", ae.Msg)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return NewError(CODE_NOT_FOUND, "not found")
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return Errorf(CODE_INVALID_REQUEST, "invalid request: %v", err)
+	}
+	log.Printf("Internal error: %v", err)
+	return NewError(CODE_INTERNAL, "internal error")
+}
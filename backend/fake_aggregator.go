@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58"
+)
+
+// An in-process stand-in for the Ivy aggregator, for running the backend
+// without any Ivy infrastructure. It serves the same routes as the real
+// aggregator, plus control routes to simulate on-chain activity:
+//
+//	POST /fake/deposits/{id}     mark a deposit as paid
+//	POST /fake/withdrawals/{id}  mark a withdrawal as claimed
+//
+// If `WebhookUrl` is set, paid deposits are also pushed there as a
+// `DepositWebhook` for `Game`, signed with `WebhookKey`.
+//
+// Tests start it directly. The backend only runs it for `FAKE_AGGREGATOR`
+// when built with `-tags fakeaggregator` (see `useFakeAggregator`), as
+// anyone who can reach it can credit themselves deposits.
+type FakeAggregator struct {
+	Url        string
+	WebhookUrl string
+	WebhookKey ed25519.PrivateKey
+	Game       [32]byte
+
+	server      *http.Server
+	mu          sync.Mutex
+	deposits    map[[32]byte]DepositInfo
+	withdrawals map[[32]byte]WithdrawInfo
+}
+
+// Starts a fake aggregator listening on `addr` (e.g. "127.0.0.1:0")
+func StartFakeAggregator(addr string) (*FakeAggregator, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &FakeAggregator{
+		Url:         "http://" + listener.Addr().String(),
+		deposits:    make(map[[32]byte]DepositInfo),
+		withdrawals: make(map[[32]byte]WithdrawInfo),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		fakeRespond(w, nil)
+	})
+	mux.HandleFunc("GET /games/{game}/deposits/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := fakeParse(w, r)
+		if !ok {
+			return
+		}
+		f.mu.Lock()
+		info, found := f.deposits[id]
+		f.mu.Unlock()
+		if !found {
+			fakeRespond(w, nil)
+			return
+		}
+		fakeRespond(w, info)
+	})
+	mux.HandleFunc("GET /games/{game}/withdrawals/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := fakeParse(w, r)
+		if !ok {
+			return
+		}
+		f.mu.Lock()
+		info, found := f.withdrawals[id]
+		f.mu.Unlock()
+		if !found {
+			fakeRespond(w, nil)
+			return
+		}
+		fakeRespond(w, info)
+	})
+	mux.HandleFunc("POST /fake/deposits/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := fakeParse(w, r)
+		if !ok {
+			return
+		}
+		fakeRespond(w, f.PayDeposit(id))
+	})
+	mux.HandleFunc("POST /fake/withdrawals/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := fakeParse(w, r)
+		if !ok {
+			return
+		}
+		fakeRespond(w, f.ClaimWithdrawal(id))
+	})
+	f.server = &http.Server{Handler: mux}
+	go func() {
+		err := f.server.Serve(listener)
+		if err != http.ErrServerClosed {
+			log.Printf("fake aggregator stopped: %v", err)
+		}
+	}()
+	return f, nil
+}
+
+// Stops the fake aggregator
+func (f *FakeAggregator) Close() error {
+	return f.server.Close()
+}
+
+// Simulates a user paying the deposit with the given ID
+func (f *FakeAggregator) PayDeposit(id [32]byte) DepositInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info := DepositInfo{
+		Signature: fakeSignature(),
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	f.deposits[id] = info
+	if f.WebhookUrl != "" {
+		go f.push(id, info)
+	}
+	return info
+}
+
+// Sends a signed deposit webhook to `WebhookUrl`
+func (f *FakeAggregator) push(id [32]byte, info DepositInfo) {
+	body, err := json.Marshal(DepositWebhook{
+		Game:      base58.Encode(f.Game[:]),
+		DepositId: hex.EncodeToString(id[:]),
+		Signature: info.Signature,
+		Timestamp: info.Timestamp,
+	})
+	if err != nil {
+		log.Printf("fake aggregator: can't encode webhook: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, f.WebhookUrl, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("fake aggregator: can't create webhook request: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, hex.EncodeToString(ed25519.Sign(f.WebhookKey, body)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("fake aggregator: webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("fake aggregator: webhook returned HTTP %d", resp.StatusCode)
+	}
+}
+
+// Simulates a user claiming the withdrawal with the given ID
+func (f *FakeAggregator) ClaimWithdrawal(id [32]byte) WithdrawInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info := WithdrawInfo{
+		Signature: fakeSignature(),
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	f.withdrawals[id] = info
+	return info
+}
+
+// A random base58 string that looks like a transaction signature
+func fakeSignature() string {
+	sig := GenerateID(0)
+	return base58.Encode(append(sig[:], sig[:]...))
+}
+
+func fakeParse(w http.ResponseWriter, r *http.Request) ([32]byte, bool) {
+	id, err := DecodeHex32(r.PathValue("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(aggregatorResponse[any]{
+			Status: "err",
+			Msg:    "invalid id: " + err.Error(),
+		})
+		return [32]byte{}, false
+	}
+	return id, true
+}
+
+func fakeRespond(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		Data   any    `json:"data"`
+	}{
+		Status: "ok",
+		Data:   data,
+	})
+}
@@ -0,0 +1,33 @@
+//go:build fakeaggregator
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"log"
+	"strconv"
+)
+
+// Starts a fake aggregator on `addr` for local development, returning its
+// URL and the key it signs deposit webhooks with. If `webhookKey` is already
+// set, the fake doesn't push webhooks, since it can't sign them with it.
+func useFakeAggregator(addr string, webhookKey *[32]byte) (string, *[32]byte, error) {
+	fake, err := StartFakeAggregator(addr)
+	if err != nil {
+		return "", nil, err
+	}
+	log.Println("Using fake aggregator at", fake.Url)
+	if webhookKey == nil {
+		// have the fake push deposits to us with a throwaway key
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", nil, err
+		}
+		fake.WebhookUrl = "http://127.0.0.1:" + strconv.Itoa(CONFIG.Port) + "/webhooks/deposit"
+		fake.WebhookKey = private
+		fake.Game = GAME_ADDRESS
+		webhookKey = (*[32]byte)(public)
+	}
+	return fake.Url, webhookKey, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live events, pushed to clients connected to `/ws`.
+//
+// Every client receives the public feed of settled bets. A client can also
+// authenticate by sending `{"type": "auth", ...}` with the usual auth fields
+// (see `AuthData`), after which it receives its user's private events too,
+// until those credentials expire or are revoked. It's then sent an `error`
+// event and goes back to the public feed, until it authenticates again.
+//
+// Events are queued for each client, and a client that falls
+// `FEED_SEND_BUFFER` events behind is dropped rather than holding up
+// whoever is publishing (e.g. `onBet`).
+type Feed struct {
+	mu      sync.RWMutex
+	clients map[*feedClient]struct{}
+}
+
+// Kinds of feed events
+const (
+	FEED_BET           = "bet"           // public: a settled bet, as a `FeedBet`
+	FEED_BALANCE       = "balance"       // private: a balance change, as a `LedgerEntry`
+	FEED_DEPOSIT       = "deposit"       // private: a completed deposit, as a `Deposit`
+	FEED_AUTHENTICATED = "authenticated" // reply to "auth", as a `FeedAuthenticated`
+	FEED_ERROR         = "error"         // reply to an invalid message, as an `ErrorResponse`
+)
+
+type FeedEvent struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+// A settled bet, as shown to everyone
+type FeedBet struct {
+	Id          uint64 `json:"id"`
+	User        string `json:"user"` // abbreviated address, see `AbbreviateAddress`
+	WagerCents  uint64 `json:"wagerCents"`
+	RollUnder   bool   `json:"rollUnder"`
+	Threshold   uint16 `json:"threshold"`
+	Result      uint16 `json:"result"`
+	Won         bool   `json:"won"`
+	PayoutCents uint64 `json:"payoutCents"`
+	CreatedAt   uint64 `json:"createdAt"`
+}
+
+type FeedAuthenticated struct {
+	UserId string `json:"userId"`
+}
+
+// A message from a client
+type FeedRequest struct {
+	Type string `json:"type"`
+	AuthData
+}
+
+type feedClient struct {
+	conn      *websocket.Conn
+	send      chan []byte
+	userId    string   // empty until authenticated
+	auth      AuthData // the credentials it authenticated with
+	expiresAt uint64   // when they expire
+}
+
+var ErrFeedAuthExpired = NewError(CODE_AUTH_EXPIRED, "credentials expired: authenticate again to receive private events")
+
+func NewFeed() *Feed {
+	return &Feed{
+		clients: make(map[*feedClient]struct{}),
+	}
+}
+
+// Shortens an address like `5EUjf4oPLzrA7w7M9EC9fDEyBBjkAVS4QgqrZhRx3G9s`
+// to `5EUj...3G9s`, so the public feed doesn't identify players outright
+func AbbreviateAddress(address string) string {
+	if len(address) <= 8 {
+		return address
+	}
+	return address[:4] + "..." + address[len(address)-4:]
+}
+
+// Publishes a settled bet to everyone
+func (f *Feed) PublishBet(bet Bet, payoutCents uint64) {
+	f.publish("", FeedEvent{
+		Type: FEED_BET,
+		Data: FeedBet{
+			Id:          bet.Id,
+			User:        AbbreviateAddress(bet.UserId),
+			WagerCents:  bet.AmountCents,
+			RollUnder:   bet.RollUnder,
+			Threshold:   bet.Threshold,
+			Result:      bet.Result,
+			Won:         bet.Won,
+			PayoutCents: payoutCents,
+			CreatedAt:   bet.CreatedAt,
+		},
+	})
+}
+
+// Publishes a balance change to its user
+func (f *Feed) PublishLedgerEntry(entry LedgerEntry) {
+	f.publish(entry.UserId, FeedEvent{
+		Type: FEED_BALANCE,
+		Data: entry,
+	})
+}
+
+// Publishes a completed deposit to its user
+func (f *Feed) PublishDeposit(deposit Deposit) {
+	f.publish(deposit.UserId, FeedEvent{
+		Type: FEED_DEPOSIT,
+		Data: deposit,
+	})
+}
+
+// Queues `event` for every client, or only those authenticated as
+// `userId` if it's set. Never blocks: clients that are too far behind
+// are dropped instead.
+func (f *Feed) publish(userId string, event FeedEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Can't encode feed event: %v", err)
+		return
+	}
+	now := uint64(time.Now().Unix())
+	var slow []*feedClient
+	expired := map[*feedClient]AuthData{}
+	f.mu.RLock()
+	for c := range f.clients {
+		if userId != "" && c.userId != userId {
+			continue
+		}
+		if userId != "" && now >= c.expiresAt {
+			expired[c] = c.auth
+			continue
+		}
+		select {
+		case c.send <- message:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	f.mu.RUnlock()
+	for _, c := range slow {
+		f.drop(c, websocket.CloseTryAgainLater, "too slow")
+	}
+	for c, auth := range expired {
+		f.deauthenticate(c, auth, ErrFeedAuthExpired)
+	}
+}
+
+// Checks the credentials of the clients authenticated as `userId` again,
+// e.g. after some were revoked, so they stop receiving private events
+func (f *Feed) Recheck(userId string) {
+	auths := map[*feedClient]AuthData{}
+	f.mu.RLock()
+	for c := range f.clients {
+		if c.userId == userId {
+			auths[c] = c.auth
+		}
+	}
+	f.mu.RUnlock()
+	for c, auth := range auths {
+		_, _, err := AuthenticateUntil(auth, SCOPE_READ)
+		if err != nil {
+			f.deauthenticate(c, auth, err)
+		}
+	}
+}
+
+// Stops sending private events to a client, telling it why, unless it
+// has authenticated with other credentials than `auth` in the meantime
+func (f *Feed) deauthenticate(c *feedClient, auth AuthData, err error) {
+	f.mu.Lock()
+	ok := c.userId != "" && c.auth == auth
+	if ok {
+		c.userId = ""
+		c.auth = AuthData{}
+		c.expiresAt = 0
+	}
+	f.mu.Unlock()
+	if ok {
+		f.replyError(c, err)
+	}
+}
+
+// Queues the error `err` for a single client
+func (f *Feed) replyError(c *feedClient, err error) {
+	e := ToUserError(err)
+	f.reply(c, FeedEvent{
+		Type: FEED_ERROR,
+		Data: ErrorResponse{Error: e.Message, Code: e.Code, Details: e.Details},
+	})
+}
+
+// Queues `event` for a single client
+func (f *Feed) reply(c *feedClient, event FeedEvent) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Can't encode feed event: %v", err)
+		return
+	}
+	f.mu.RLock()
+	_, ok := f.clients[c]
+	full := false
+	if ok {
+		select {
+		case c.send <- message:
+		default:
+			full = true
+		}
+	}
+	f.mu.RUnlock()
+	if full {
+		f.drop(c, websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+// Disconnects a client, if it's still connected. Its queue is closed
+// while holding the lock, so that nothing is sent on it afterwards.
+func (f *Feed) drop(c *feedClient, code int, reason string) {
+	f.mu.Lock()
+	_, ok := f.clients[c]
+	if ok {
+		delete(f.clients, c)
+		close(c.send)
+	}
+	f.mu.Unlock()
+	if !ok {
+		return
+	}
+	// The close frame waits for any write in progress, which for a slow
+	// client may take a while, so don't hold up the caller
+	go func() {
+		deadline := time.Now().Add(FEED_WRITE_TIMEOUT)
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+		c.conn.Close()
+	}()
+}
+
+// Serves `/ws`
+func (f *Feed) Handler() http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		// clients authenticate explicitly rather than with cookies,
+		// so any site may connect, just like with the rest of the API
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already replied
+			return
+		}
+		c := &feedClient{
+			conn: conn,
+			send: make(chan []byte, FEED_SEND_BUFFER),
+		}
+		f.mu.Lock()
+		f.clients[c] = struct{}{}
+		f.mu.Unlock()
+
+		go f.write(c)
+		f.read(c)
+	}
+}
+
+// Handles messages from a client until it disconnects
+func (f *Feed) read(c *feedClient) {
+	c.conn.SetReadLimit(FEED_MAX_MESSAGE_SIZE)
+	c.conn.SetReadDeadline(time.Now().Add(FEED_PONG_TIMEOUT))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(FEED_PONG_TIMEOUT))
+	})
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			f.drop(c, websocket.CloseNormalClosure, "")
+			return
+		}
+		var request FeedRequest
+		err = json.Unmarshal(message, &request)
+		if err == nil && request.Type != "auth" {
+			err = Errorf(CODE_INVALID_REQUEST, "unknown message type %q", request.Type)
+		}
+		var userId string
+		var expiresAt uint64
+		if err == nil {
+			userId, expiresAt, err = AuthenticateUntil(request.AuthData, SCOPE_READ)
+		}
+		if err != nil {
+			f.replyError(c, err)
+			continue
+		}
+		f.mu.Lock()
+		c.userId = userId
+		c.auth = request.AuthData
+		c.expiresAt = expiresAt
+		f.mu.Unlock()
+		f.reply(c, FeedEvent{
+			Type: FEED_AUTHENTICATED,
+			Data: FeedAuthenticated{UserId: userId},
+		})
+	}
+}
+
+// Writes queued events to a client, and pings it to
+// detect dead connections, until it's dropped
+func (f *Feed) write(c *feedClient) {
+	ticker := time.NewTicker(FEED_PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(FEED_WRITE_TIMEOUT))
+			err := c.conn.WriteMessage(websocket.TextMessage, message)
+			if err != nil {
+				f.drop(c, websocket.CloseGoingAway, "")
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(FEED_WRITE_TIMEOUT))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				f.drop(c, websocket.CloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// A version of the game parameters. Versions are recorded in the
+// `game_params` table, and every bet records the version it was settled
+// under, so that changing the parameters never changes past results.
+type GameParams struct {
+	GameConfig
+	Version uint64 `json:"version"`
+}
+
+// The parameters currently in effect. Bets load this once and use that
+// snapshot throughout, so a bet in flight keeps the parameters it started
+// with even if they're swapped out from under it.
+var gameParams atomic.Pointer[GameParams]
+
+// Serializes updates to `gameParams` and `gameConfigLoaded`
+var gameParamsMu sync.Mutex
+
+// The `[game]` section of the config as last read, so that reloading
+// it only applies the settings that were changed in it
+var gameConfigLoaded GameConfig
+
+var ErrNotAdmin = NewError(CODE_FORBIDDEN, "this action is restricted to admins")
+
+// Returns the game parameters currently in effect
+func CurrentGameParams() *GameParams {
+	return gameParams.Load()
+}
+
+// Loads the game parameters at startup: the latest recorded version, so that
+// changes made with `set_game_params` survive restarts, or `g` (the config's
+// `[game]` section) if no version has been recorded yet.
+func LoadGameParams(g GameConfig) (GameParams, error) {
+	gameParamsMu.Lock()
+	defer gameParamsMu.Unlock()
+	gameConfigLoaded = g
+
+	gp, err := DB.GameParamsLatest()
+	if err == sql.ErrNoRows {
+		return applyGameParams(g)
+	}
+	if err != nil {
+		return GameParams{}, err
+	}
+	if gp.GameConfig != g {
+		log.Printf("Game parameters version %d differs from the config's [game] section, which only seeds them: edit it and send SIGHUP, or use set_game_params, to change them", gp.Version)
+	}
+	log.Printf("Game parameters are now version %d: %+v", gp.Version, gp.GameConfig)
+	gameParams.Store(&gp)
+	return gp, nil
+}
+
+// Validates `g` and makes it the current game parameters, recording a new
+// version if they differ from the latest recorded version.
+func ApplyGameParams(g GameConfig) (GameParams, error) {
+	gameParamsMu.Lock()
+	defer gameParamsMu.Unlock()
+	return applyGameParams(g)
+}
+
+// Like `ApplyGameParams`, but `gameParamsMu` must be held
+func applyGameParams(g GameConfig) (GameParams, error) {
+	err := g.Validate()
+	if err != nil {
+		return GameParams{}, NewError(CODE_INVALID_REQUEST, err.Error())
+	}
+
+	var gp GameParams
+	err = DB.WithTx(func(tx *Tx) error {
+		var err error
+		gp, err = tx.GameParamsLatest()
+		if err == nil && gp.GameConfig == g {
+			// nothing changed, keep the current version
+			return nil
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		gp, err = tx.GameParamsCreate(g)
+		return err
+	})
+	if err != nil {
+		return GameParams{}, err
+	}
+
+	if current := gameParams.Load(); current == nil || current.Version != gp.Version {
+		log.Printf("Game parameters are now version %d: %+v", gp.Version, gp.GameConfig)
+	}
+	gameParams.Store(&gp)
+	return gp, nil
+}
+
+// Re-reads the `[game]` section of the config (file, env and flags), and
+// applies the settings that changed in it since it was last read on top of
+// the current parameters. Settings changed with `set_game_params` are kept,
+// unless the config changes them too. Other settings only take effect on
+// restart.
+func ReloadGameParams() error {
+	c, _, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	gameParamsMu.Lock()
+	defer gameParamsMu.Unlock()
+	g := CurrentGameParams().GameConfig
+	current := reflect.ValueOf(&g).Elem()
+	before, after := reflect.ValueOf(gameConfigLoaded), reflect.ValueOf(c.Game)
+	for i := range current.NumField() {
+		if !before.Field(i).Equal(after.Field(i)) {
+			current.Field(i).Set(after.Field(i))
+		}
+	}
+	_, err = applyGameParams(g)
+	if err != nil {
+		return err
+	}
+	gameConfigLoaded = c.Game
+	return nil
+}
+
+// Returns whether `userId` may call admin actions
+func IsAdmin(userId string) bool {
+	return slices.Contains(CONFIG.Admins, userId)
+}
+
+func onGameParams() (GameParams, error) {
+	return *CurrentGameParams(), nil
+}
+
+type SetGameParamsParams struct {
+	AuthData
+	// The parameters to change, as in `GameConfig`. Omitted fields keep their current value.
+	Params json.RawMessage `json:"params"`
+}
+
+func onSetGameParams(p SetGameParamsParams) (GameParams, error) {
+	// (1) Authenticate admin
+	userId, err := Authenticate(p.AuthData, SCOPE_ACCOUNT)
+	if err != nil {
+		return GameParams{}, err
+	}
+	if !IsAdmin(userId) {
+		return GameParams{}, ErrNotAdmin
+	}
+
+	// (2) Apply changes on top of the current parameters
+	g := CurrentGameParams().GameConfig
+	if len(p.Params) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(p.Params))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&g)
+		if err != nil {
+			return GameParams{}, Errorf(CODE_INVALID_REQUEST, "invalid params: %v", err)
+		}
+	}
+	gp, err := ApplyGameParams(g)
+	if err != nil {
+		return GameParams{}, err
+	}
+	log.Printf("Game parameters version %d set by admin %s", gp.Version, userId)
+	return gp, nil
+}
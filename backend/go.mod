@@ -5,3 +5,7 @@ go 1.24.4
 require github.com/mattn/go-sqlite3 v1.14.28
 
 require github.com/mr-tron/base58 v1.2.0
+
+require github.com/BurntSushi/toml v1.5.0
+
+require github.com/gorilla/websocket v1.5.3
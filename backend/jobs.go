@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Calls `f` every `interval`, forever
+func runEvery(interval time.Duration, f func()) {
+	for {
+		f()
+		time.Sleep(interval)
+	}
+}
+
+// The maximum number of rows a single sweep will process
+const SWEEP_BATCH_SIZE = 100
+
+// Refunds withdrawals that weren't claimed within WITHDRAW_CLAIM_WINDOW.
+//
+// Before expiring a withdrawal we ask the aggregator one last time
+// whether it was claimed. Note that the on-chain program has no notion
+// of expiry, so a user who kept the signed URL can still claim it after
+// the refund; `checkRefundedWithdrawals` catches that, and takes the
+// refund back.
+func sweepWithdrawals() {
+	withdrawals, err := DB.WithdrawListExpired(uint64(time.Now().Unix()), SWEEP_BATCH_SIZE)
+	if err != nil {
+		log.Printf("Withdrawal sweep: can't list expired withdrawals: %v", err)
+		return
+	}
+	for _, w := range withdrawals {
+		err := sweepWithdrawal(w)
+		if err != nil {
+			log.Printf("Withdrawal sweep: can't process withdrawal %s: %v", w.Id, err)
+		}
+	}
+}
+
+func sweepWithdrawal(w Withdrawal) error {
+	// (1) Was it claimed after all?
+	updated, err := checkWithdrawal(context.Background(), w)
+	if err != nil {
+		return err
+	}
+	if updated.Completed {
+		return nil
+	}
+
+	// (2) Nope, so expire + refund it
+	err = DB.WithTx(func(tx *Tx) error {
+		err := tx.WithdrawExpire(w.Id)
+		if err != nil {
+			return err
+		}
+		return tx.UserCredit(w.UserId, w.AmountCents, LEDGER_WITHDRAWAL_REFUND, w.Id)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Withdrawal sweep: expired withdrawal %s, refunded %d cents to %s", w.Id, w.AmountCents, w.UserId)
+	return nil
+}
+
+// Checks refunded withdrawals for late claims, least recently checked
+// first. They stay claimable on-chain forever, so we never stop checking.
+func checkRefundedWithdrawals() {
+	withdrawals, err := DB.WithdrawListRefunded(SWEEP_BATCH_SIZE)
+	if err != nil {
+		log.Printf("Late claim check: can't list refunded withdrawals: %v", err)
+		return
+	}
+	for _, w := range withdrawals {
+		_, err := checkWithdrawal(context.Background(), w)
+		if err != nil {
+			log.Printf("Late claim check: can't check withdrawal %s: %v", w.Id, err)
+			continue
+		}
+		err = DB.WithdrawSetChecked(w.Id, uint64(time.Now().Unix()))
+		if err != nil {
+			log.Printf("Late claim check: can't update withdrawal %s: %v", w.Id, err)
+		}
+	}
+}
+
+// Expires deposit intents that are older than DEPOSIT_INTENT_TTL. Each
+// one is checked against the aggregator one last time first, so a late
+// payment is completed instead. (A payment landing after expiry can still
+// be picked up by `deposit_status`, which also checks expired deposits.)
+func sweepDeposits() {
+	deposits, err := DB.DepositListExpired(uint64(time.Now().Unix()), SWEEP_BATCH_SIZE)
+	if err != nil {
+		log.Printf("Deposit sweep: can't list expired deposits: %v", err)
+		return
+	}
+	for _, d := range deposits {
+		updated, err := checkDeposit(context.Background(), d)
+		if err != nil {
+			log.Printf("Deposit sweep: can't check deposit %s: %v", d.Id, err)
+			continue
+		}
+		if updated.Completed {
+			continue
+		}
+		err = DB.DepositExpire(d.Id)
+		if err != nil {
+			log.Printf("Deposit sweep: can't expire deposit %s: %v", d.Id, err)
+			continue
+		}
+		updated.Expired = true
+		DEPOSIT_EVENTS.Publish(updated)
+	}
+}
+
+// Credits deposits in the background, so users who pay and close the tab
+// don't have to come back and press "Check". Checks up to SWEEP_BATCH_SIZE
+// pending deposits that are due, DEPOSIT_WATCH_CONCURRENCY at a time. Each
+// deposit that's still pending (or fails) is retried with exponential
+// backoff, starting at DEPOSIT_WATCH_INTERVAL up to DEPOSIT_WATCH_MAX_BACKOFF.
+func watchDeposits() {
+	deposits, err := DB.DepositListDue(uint64(time.Now().Unix()), SWEEP_BATCH_SIZE)
+	if err != nil {
+		log.Printf("Deposit watcher: can't list pending deposits: %v", err)
+		return
+	}
+
+	sem := make(chan struct{}, DEPOSIT_WATCH_CONCURRENCY)
+	var wg sync.WaitGroup
+	for _, d := range deposits {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(d Deposit) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			watchDeposit(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func watchDeposit(d Deposit) {
+	updated, err := checkDeposit(context.Background(), d)
+	if err != nil {
+		log.Printf("Deposit watcher: can't check deposit %s: %v", d.Id, err)
+	}
+	if err == nil && updated.Completed {
+		log.Printf("Deposit watcher: deposit %s of %d cents to %s is complete", d.Id, d.AmountCents, d.UserId)
+		return
+	}
+	err = DB.DepositBackOff(d.Id, uint64(time.Now().Unix()), DEPOSIT_WATCH_INTERVAL, DEPOSIT_WATCH_MAX_BACKOFF)
+	if err != nil {
+		log.Printf("Deposit watcher: can't schedule deposit %s: %v", d.Id, err)
+	}
+}
@@ -1,61 +1,96 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/ivypowered/ivy-dice/backend/dice"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mr-tron/base58"
 )
 
-var GAME_ADDRESS = MustDecodeBase58PublicKey(os.Getenv("GAME"))
-var WITHDRAW_AUTHORITY_PRIVATE_KEY = MustDecodeHexPrivateKey(os.Getenv("WITHDRAW_AUTHORITY_PRIVATE_KEY"))
-
-const IVY_URL = "https://ivypowered.com"
-const PORT = 8000
-const DB_PATH = "./backend.db"
-const CLIENT_SEED_MIN_LENGTH = 6
-const CLIENT_SEED_MAX_LENGTH = 32
-const AGGREGATOR_URL = "http://127.0.0.1:5000"
-
-const HOUSE_EDGE_PCT = 1 // 1%
-const UNDER_MIN = 1
-const UNDER_MAX = 9802
-const OVER_MIN = 197
-const OVER_MAX = 9899
-const MAX_BET_CENTS = 300000_00
-
+// Read from the environment at startup
+var GAME_ADDRESS [32]byte
+var WITHDRAW_AUTHORITY_PRIVATE_KEY [64]byte
+
+// Aggregator calls: each attempt gets `AGGREGATOR_TIMEOUT`, failed calls are
+// retried `AGGREGATOR_RETRIES` times with exponential backoff, and after
+// `AGGREGATOR_BREAKER_THRESHOLD` failed calls in a row we stop trying for
+// `AGGREGATOR_BREAKER_COOLDOWN`. Answers are cached for `AGGREGATOR_CACHE_TTL`.
+const AGGREGATOR_TIMEOUT = 3 * time.Second
+const AGGREGATOR_RETRIES = 2
+const AGGREGATOR_RETRY_DELAY = 200 * time.Millisecond
+const AGGREGATOR_BREAKER_THRESHOLD = 5
+const AGGREGATOR_BREAKER_COOLDOWN = 30 * time.Second
+const AGGREGATOR_CACHE_TTL = 5 * time.Second
+
+// The longest an auth message may be valid for, and how far
+// our clock may disagree with the client's
+const AUTH_MESSAGE_MAX_VALIDITY = 7 * 24 * time.Hour
+const AUTH_CLOCK_SKEW = time.Minute
+
+// How long API keys are valid for if no expiry is given, and at most
+const API_KEY_DEFAULT_TTL = 90 * 24 * time.Hour
+const API_KEY_MAX_TTL = 365 * 24 * time.Hour
+
+// How long a session token from `login` is valid for, and how often
+// we forget revoked sessions that have expired anyway
+const SESSION_TTL = 15 * time.Minute
+const SESSION_PRUNE_INTERVAL = time.Hour
+
+// How long users have to claim a withdrawal before it's refunded, and how
+// often refunded withdrawals are checked for late claims (see `completeWithdrawal`)
+const WITHDRAW_CLAIM_WINDOW = 24 * time.Hour
+const WITHDRAW_SWEEP_INTERVAL = time.Minute
+const WITHDRAW_LATE_CLAIM_INTERVAL = 10 * time.Minute
+
+// How long a deposit intent stays pending before it's expired
+const DEPOSIT_INTENT_TTL = 24 * time.Hour
+const DEPOSIT_SWEEP_INTERVAL = time.Minute
+
+// How often the deposit watcher looks for pending deposits, how many
+// it checks at once, and how far it backs off from a single deposit
+const DEPOSIT_WATCH_INTERVAL = 10 * time.Second
+const DEPOSIT_WATCH_CONCURRENCY = 4
+const DEPOSIT_WATCH_MAX_BACKOFF = 10 * time.Minute
+
+// Live feed (`/ws`): how many events may be queued for a client before
+// it's dropped, how long a write may take, and how often we ping clients
+// and how long they have to answer. Clients only ever send auth messages,
+// so those are capped at `FEED_MAX_MESSAGE_SIZE` bytes.
+const FEED_SEND_BUFFER = 64
+const FEED_WRITE_TIMEOUT = 10 * time.Second
+const FEED_PING_INTERVAL = 30 * time.Second
+const FEED_PONG_TIMEOUT = 60 * time.Second
+const FEED_MAX_MESSAGE_SIZE = 4096
+
+// How often deposit event streams send a heartbeat while waiting, and how
+// long they wait before ending anyway (clients are expected to reconnect)
+const DEPOSIT_EVENTS_HEARTBEAT_INTERVAL = 15 * time.Second
+const DEPOSIT_EVENTS_MAX_DURATION = 10 * time.Minute
+
+var CONFIG = DefaultConfig()
 var DB Database
+var AGGREGATOR Aggregator
+var SESSIONS *Sessions
+var FEED = NewFeed()
+var DEPOSIT_EVENTS = NewDepositEvents()
 
-// Roll returns a random integer in the range [0, 10000).
-func Roll(serverSeed []byte, clientSeed []byte) uint16 {
-	// hash server seed + client seed together
-	seed := make([]byte, 0, len(serverSeed)+len(clientSeed))
-	seed = append(seed, serverSeed...)
-	seed = append(seed, clientSeed...)
-	hash := sha256.Sum256(seed)
-	// get random 64-bit integer
-	n := binary.LittleEndian.Uint64(hash[:8])
-	// convert it to range by taking it mod 10,000
-	// (This results in a very, very small
-	// bias towards small numbers: we will produce
-	// an unfair result with probability ((2**64)%10000)/(2**64),
-	// or 8.760353553682876e-17. This is satisfactory for our
-	// use case)
-	return uint16(n % 10_000)
-}
+var ErrAccountFrozen = NewError(CODE_ACCOUNT_FROZEN, "account frozen: please contact support")
 
 // Generate a 32-byte server seed
 func NewServerSeed() [32]byte {
@@ -67,29 +102,31 @@ func NewServerSeed() [32]byte {
 	return seed
 }
 
-type AuthData struct {
-	Message   string `json:"message"`
-	Signature string `json:"signature"`
-}
-
-type ErrorResponse struct {
-	Error string `json:"error"`
+// Generate a random 16-character hex client seed
+func NewClientSeed() string {
+	var seed [8]byte
+	_, err := io.ReadFull(rand.Reader, seed[:])
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(seed[:])
 }
 
 type UserGetParams struct {
-	Message   string `json:"message"`
-	Signature string `json:"signature"`
+	AuthData
 }
 
 // / A client-side user
 type UserClient struct {
 	Id             string `json:"id"`
 	ServerSeedHash string `json:"serverSeedHash"`
+	ClientSeed     string `json:"clientSeed"`
+	Nonce          uint64 `json:"nonce"`
 	BalanceCents   uint64 `json:"balanceCents"`
 }
 
 func onUserGet(p UserGetParams) (UserClient, error) {
-	id, err := VerifyMessageB58(GAME_ADDRESS, p.Message, p.Signature)
+	id, err := Authenticate(p.AuthData, SCOPE_READ)
 	if err != nil {
 		return UserClient{}, err
 	}
@@ -97,148 +134,453 @@ func onUserGet(p UserGetParams) (UserClient, error) {
 	if err != nil {
 		return UserClient{}, err
 	}
-	ss, err := hex.DecodeString(user.ServerSeed)
+	sp, err := DB.SeedPairGetActive(user.Id)
+	if err != nil {
+		return UserClient{}, err
+	}
+	ssHash, err := dice.HashServerSeed(sp.ServerSeed)
 	if err != nil {
 		return UserClient{}, err
 	}
-	ssHash := sha256.Sum256(ss)
-	ssHashHex := hex.EncodeToString(ssHash[:])
 	return UserClient{
 		Id:             user.Id,
-		ServerSeedHash: ssHashHex,
+		ServerSeedHash: ssHash,
+		ClientSeed:     sp.ClientSeed,
+		Nonce:          sp.Nonce,
 		BalanceCents:   user.BalanceCents,
 	}, nil
 }
 
+// The wager of a single bet
+type BetSpec struct {
+	WagerCents uint64 `json:"wagerCents" schema:"required"`
+	RollUnder  bool   `json:"rollUnder" schema:"required"`
+	Threshold  uint16 `json:"threshold" schema:"required,maximum=9999"`
+}
+
 type BetParams struct {
-	Message    string `json:"message"`
-	Signature  string `json:"signature"`
-	WagerCents uint64 `json:"wagerCents"`
-	RollUnder  bool   `json:"rollUnder"`
-	Threshold  uint16 `json:"threshold"`
-	ClientSeed string `json:"clientSeed"`
+	AuthData
+	BetSpec
 }
 
 type BetResult struct {
-	Won        bool   `json:"won"`
-	DeltaCents int64  `json:"deltaCents"`
-	ServerSeed string `json:"serverSeed"`
-	Result     uint16 `json:"result"`
+	Won              bool   `json:"won"`
+	DeltaCents       int64  `json:"deltaCents"`
+	Result           uint16 `json:"result"`
+	SeedPairId       uint64 `json:"seedPairId"` // `seedPairId` in `bet_list`, so the bet can be tied to `serverSeedHash`
+	ServerSeedHash   string `json:"serverSeedHash"`
+	ClientSeed       string `json:"clientSeed"`
+	Nonce            uint64 `json:"nonce"`
+	AlgorithmVersion uint8  `json:"algorithmVersion"`
+	HouseEdgePct     uint64 `json:"houseEdgePct"`
+	ParamsVersion    uint64 `json:"paramsVersion"`
+}
+
+// Checks a wager against the game parameters and, if the bet is
+// made with an API key, the key's limit
+func validateWager(params *GameParams, key *ApiKey, spec BetSpec) error {
+	if spec.WagerCents > params.MaxBetCents {
+		e := Errorf(CODE_WAGER_OUT_OF_RANGE, "invalid bet: the maximum bet is %.2f, but you're trying to bet %.2f!", float64(params.MaxBetCents)/100, float64(spec.WagerCents)/100)
+		e.Details = map[string]any{"maxCents": params.MaxBetCents, "wagerCents": spec.WagerCents}
+		return e
+	}
+	if key != nil && key.MaxWagerCents > 0 && spec.WagerCents > key.MaxWagerCents {
+		e := Errorf(CODE_WAGER_OUT_OF_RANGE, "invalid bet: this API key may bet at most %.2f, but you're trying to bet %.2f!", float64(key.MaxWagerCents)/100, float64(spec.WagerCents)/100)
+		e.Details = map[string]any{"maxCents": key.MaxWagerCents, "wagerCents": spec.WagerCents}
+		return e
+	}
+	return nil
+}
+
+func insufficientBalance(balanceCents uint64, wagerCents uint64) error {
+	e := Errorf(CODE_INSUFFICIENT_BALANCE, "insufficient balance: you only have %.2f but you're trying to bet %.2f!", float64(balanceCents)/100, float64(wagerCents)/100)
+	e.Details = map[string]any{"balanceCents": balanceCents, "wagerCents": wagerCents}
+	return e
+}
+
+// Rolls a bet with nonce `nonce` of seed pair `sp`, records it, and moves
+// the stake and any payout. Consuming the nonce is up to the caller.
+// Should be run inside of a transaction.
+func settleBet(tx *Tx, params *GameParams, sp SeedPair, nonce uint64, spec BetSpec) (Bet, dice.Outcome, error) {
+	// (1) Roll the dice
+	roll, err := dice.Roll(dice.AlgorithmLatest, sp.ServerSeed, sp.ClientSeed, nonce)
+	if err != nil {
+		return Bet{}, dice.Outcome{}, err
+	}
+	// (2) Compute delta
+	outcome := dice.Settle(spec.WagerCents, spec.RollUnder, spec.Threshold, roll, params.HouseEdgePct)
+
+	// (3) Record the bet
+	bet := Bet{
+		UserId:           sp.UserId,
+		AmountCents:      spec.WagerCents,
+		RollUnder:        spec.RollUnder,
+		Threshold:        spec.Threshold,
+		Result:           roll,
+		Won:              outcome.Won,
+		SeedPairId:       sp.Id,
+		AlgorithmVersion: dice.AlgorithmLatest,
+		ServerSeed:       sp.ServerSeed, // withheld by BetList until the pair is rotated
+		ClientSeed:       sp.ClientSeed,
+		Nonce:            nonce,
+		HouseEdgePct:     params.HouseEdgePct,
+		ParamsVersion:    params.Version,
+		CreatedAt:        uint64(time.Now().Unix()),
+	}
+	bet.Id, err = tx.BetCreate(bet)
+	if err != nil {
+		return Bet{}, dice.Outcome{}, fmt.Errorf("failed to record bet: %v", err)
+	}
+
+	// (4) Take the stake, then pay out winnings
+	betRef := strconv.FormatUint(bet.Id, 10)
+	_, err = tx.UserAdjust(bet.UserId, -int64(spec.WagerCents), LEDGER_BET_STAKE, betRef)
+	if err != nil {
+		return Bet{}, dice.Outcome{}, err
+	}
+	if outcome.PayoutCents > 0 {
+		err = tx.UserCredit(bet.UserId, outcome.PayoutCents, LEDGER_BET_PAYOUT, betRef)
+		if err != nil {
+			return Bet{}, dice.Outcome{}, err
+		}
+	}
+	return bet, outcome, nil
+}
+
+// Describes a settled bet to the user who placed it
+func betResult(bet Bet, outcome dice.Outcome, ssHash string) BetResult {
+	return BetResult{
+		Won:              outcome.Won,
+		DeltaCents:       outcome.DeltaCents,
+		Result:           bet.Result,
+		SeedPairId:       bet.SeedPairId,
+		ServerSeedHash:   ssHash,
+		ClientSeed:       bet.ClientSeed,
+		Nonce:            bet.Nonce,
+		AlgorithmVersion: bet.AlgorithmVersion,
+		HouseEdgePct:     bet.HouseEdgePct,
+		ParamsVersion:    bet.ParamsVersion,
+	}
 }
 
 func onBet(p BetParams) (BetResult, error) {
-	// (1) Validate threshold
-	if p.RollUnder {
-		if p.Threshold < UNDER_MIN {
-			return BetResult{}, fmt.Errorf("invalid threshold: minimum amount to roll under is %d, but got %d", UNDER_MIN, p.Threshold)
+	// (1) Validate threshold, against the parameters this bet will use throughout
+	params := CurrentGameParams()
+	err := params.ValidateThreshold(p.RollUnder, p.Threshold)
+	if err != nil {
+		return BetResult{}, err
+	}
+	// (2) Authenticate
+	id, key, err := AuthenticateWithKey(p.AuthData, SCOPE_BET)
+	if err != nil {
+		return BetResult{}, err
+	}
+
+	// Everything from here on commits or rolls back together
+	var result BetResult
+	var bet Bet
+	var outcome dice.Outcome
+	err = DB.WithTx(func(tx *Tx) error {
+		// (3) Fetch user + validate wager
+		user, err := tx.UserGet(id)
+		if err != nil {
+			return err
 		}
-		if p.Threshold > UNDER_MAX {
-			return BetResult{}, fmt.Errorf("invalid threshold: maximum amount to roll under is %d, but got %d", UNDER_MAX, p.Threshold)
+		if user.Frozen {
+			return ErrAccountFrozen
 		}
-	} else {
-		if p.Threshold < OVER_MIN {
-			return BetResult{}, fmt.Errorf("invalid threshold: minimum amount to roll over is %d, but got %d", OVER_MIN, p.Threshold)
+		if p.WagerCents > user.BalanceCents {
+			return insufficientBalance(user.BalanceCents, p.WagerCents)
 		}
-		if p.Threshold > OVER_MAX {
-			return BetResult{}, fmt.Errorf("invalid threshold: maximum amount to roll over is %d, but got %d", OVER_MAX, p.Threshold)
+		err = validateWager(params, key, p.BetSpec)
+		if err != nil {
+			return err
 		}
-	}
-	// (2) Authenticate + fetch user
-	id, err := VerifyMessageB58(GAME_ADDRESS, p.Message, p.Signature)
+		// (4) Fetch active seed pair
+		sp, err := tx.SeedPairGetActive(user.Id)
+		if err != nil {
+			return err
+		}
+		ssHash, err := dice.HashServerSeed(sp.ServerSeed)
+		if err != nil {
+			return err
+		}
+		// (5) Consume the nonce
+		err = tx.SeedPairAdvanceNonce(sp, 1)
+		if err != nil {
+			return err
+		}
+		// (6) Roll, record + settle the bet
+		bet, outcome, err = settleBet(tx, params, sp, sp.Nonce, p.BetSpec)
+		if err != nil {
+			return err
+		}
+		result = betResult(bet, outcome, ssHash)
+		return nil
+	})
 	if err != nil {
 		return BetResult{}, err
 	}
-	user, err := DB.UserGet(id)
+
+	// (7) Announce it + return result
+	FEED.PublishBet(bet, outcome.PayoutCents)
+	return result, nil
+}
+
+type BetBatchParams struct {
+	AuthData
+	Bets            []BetSpec `json:"bets" schema:"required,minItems=1,maxItems=100"`
+	StopLossCents   uint64    `json:"stopLossCents"`   // optional: stop once the batch has lost at least this much
+	TakeProfitCents uint64    `json:"takeProfitCents"` // optional: stop once the batch has won at least this much
+}
+
+// Why a batch of bets stopped before placing them all
+const (
+	BET_BATCH_STOP_LOSS            = "stop_loss"
+	BET_BATCH_TAKE_PROFIT          = "take_profit"
+	BET_BATCH_INSUFFICIENT_BALANCE = "insufficient_balance"
+)
+
+type BetBatchResult struct {
+	Results      []BetResult `json:"results"`             // one for each bet placed, in order
+	DeltaCents   int64       `json:"deltaCents"`          // the net change to the balance
+	BalanceCents uint64      `json:"balanceCents"`        // the balance afterwards
+	StoppedBy    string      `json:"stoppedBy,omitempty"` // set if the batch stopped early, see `BET_BATCH_*`
+}
+
+func onBetBatch(p BetBatchParams) (BetBatchResult, error) {
+	// (1) Authenticate
+	id, key, err := AuthenticateWithKey(p.AuthData, SCOPE_BET)
 	if err != nil {
-		return BetResult{}, err
+		return BetBatchResult{}, err
 	}
-	// (3) Validate wager
-	if p.WagerCents > user.BalanceCents {
-		return BetResult{}, fmt.Errorf("insufficient balance: you only have %.2f but you're trying to bet %.2f!", float64(user.BalanceCents)/100, float64(p.WagerCents)/100)
+	// (2) Validate every bet up front, so a bad one can't stop the batch
+	// halfway, against the parameters the batch will use throughout
+	params := CurrentGameParams()
+	for i, spec := range p.Bets {
+		err := params.ValidateThreshold(spec.RollUnder, spec.Threshold)
+		if err == nil {
+			err = validateWager(params, key, spec)
+		}
+		if err != nil {
+			// both make a fresh error, so it's ours to change
+			e := ToUserError(err)
+			e.Message = fmt.Sprintf("bet %d: %s", i, e.Message)
+			e.Details["index"] = i
+			return BetBatchResult{}, e
+		}
 	}
-	if p.WagerCents > MAX_BET_CENTS {
-		return BetResult{}, fmt.Errorf("invalid bet: the maximum bet is %.2f, but you're trying to bet %.2f!", float64(MAX_BET_CENTS)/100, float64(p.WagerCents)/100)
+
+	// Everything from here on commits or rolls back together
+	var result BetBatchResult
+	var bets []Bet
+	var payouts []uint64
+	err = DB.WithTx(func(tx *Tx) error {
+		// (3) Fetch user + active seed pair, once for the whole batch
+		user, err := tx.UserGet(id)
+		if err != nil {
+			return err
+		}
+		if user.Frozen {
+			return ErrAccountFrozen
+		}
+		sp, err := tx.SeedPairGetActive(user.Id)
+		if err != nil {
+			return err
+		}
+		ssHash, err := dice.HashServerSeed(sp.ServerSeed)
+		if err != nil {
+			return err
+		}
+
+		// (4) Settle bets in order, on consecutive nonces
+		balance := user.BalanceCents
+		for i, spec := range p.Bets {
+			if spec.WagerCents > balance {
+				if i == 0 {
+					return insufficientBalance(balance, spec.WagerCents)
+				}
+				result.StoppedBy = BET_BATCH_INSUFFICIENT_BALANCE
+				break
+			}
+			bet, outcome, err := settleBet(tx, params, sp, sp.Nonce+uint64(i), spec)
+			if err != nil {
+				return err
+			}
+			balance = balance - spec.WagerCents + outcome.PayoutCents
+			result.Results = append(result.Results, betResult(bet, outcome, ssHash))
+			result.DeltaCents += outcome.DeltaCents
+			bets = append(bets, bet)
+			payouts = append(payouts, outcome.PayoutCents)
+
+			// (5) Stop early if we've hit a limit, unless this was the last bet anyway
+			if i == len(p.Bets)-1 {
+				break
+			}
+			if p.StopLossCents > 0 && result.DeltaCents <= -int64(p.StopLossCents) {
+				result.StoppedBy = BET_BATCH_STOP_LOSS
+				break
+			}
+			if p.TakeProfitCents > 0 && result.DeltaCents >= int64(p.TakeProfitCents) {
+				result.StoppedBy = BET_BATCH_TAKE_PROFIT
+				break
+			}
+		}
+		result.BalanceCents = balance
+
+		// (6) Consume the nonces we used
+		return tx.SeedPairAdvanceNonce(sp, uint64(len(bets)))
+	})
+	if err != nil {
+		return BetBatchResult{}, err
 	}
-	// (4) Validate client seed
-	if len(p.ClientSeed) < CLIENT_SEED_MIN_LENGTH || len(p.ClientSeed) > CLIENT_SEED_MAX_LENGTH {
-		return BetResult{}, fmt.Errorf("incorrect client seed length: got %d, but must be within interval [%d, %d]", len(p.ClientSeed), CLIENT_SEED_MIN_LENGTH, CLIENT_SEED_MAX_LENGTH)
+
+	// (7) Announce them + return results
+	for i, bet := range bets {
+		FEED.PublishBet(bet, payouts[i])
 	}
-	// (5) Fetch server seed
-	serverSeed, err := hex.DecodeString(user.ServerSeed)
-	if err != nil || len(serverSeed) != 32 {
-		return BetResult{}, errors.New("error decoding server seed")
+	return result, nil
+}
+
+type VerifyBetParams struct {
+	ServerSeed       string  `json:"serverSeed" schema:"required,pattern=^[0-9a-fA-F]{64}$"`
+	ClientSeed       string  `json:"clientSeed" schema:"required"`
+	Nonce            uint64  `json:"nonce" schema:"required"`
+	RollUnder        bool    `json:"rollUnder" schema:"required"`
+	Threshold        uint16  `json:"threshold" schema:"required,maximum=9999"`
+	WagerCents       uint64  `json:"wagerCents" schema:"maximum=18446744073709"` // at most `MAX_WAGER_CENTS`
+	AlgorithmVersion *uint8  `json:"algorithmVersion"`                           // optional: defaults to v1, see `dice.AlgorithmUnrecorded`
+	HouseEdgePct     *uint64 `json:"houseEdgePct" schema:"maximum=99"`           // optional: defaults to the current edge
+}
+
+type VerifyBetResult struct {
+	ServerSeedHash string `json:"serverSeedHash"`
+	Result         uint16 `json:"result"`
+	Won            bool   `json:"won"`
+	PayoutCents    uint64 `json:"payoutCents"`
+	DeltaCents     int64  `json:"deltaCents"`
+}
+
+// Recomputes a bet from its revealed seeds, so that players
+// can check a result without redoing the math by hand.
+func onVerifyBet(p VerifyBetParams) (VerifyBetResult, error) {
+	// (1) Validate parameters. Thresholds are checked loosely, since the
+	// bet may have been made under different game parameters.
+	if p.Threshold > 9999 {
+		e := Errorf(CODE_THRESHOLD_OUT_OF_RANGE, "invalid threshold: must be at most 9999, but got %d", p.Threshold)
+		e.Details = map[string]any{"min": 0, "max": 9999, "threshold": p.Threshold}
+		return VerifyBetResult{}, e
+	}
+	if p.WagerCents > MAX_WAGER_CENTS {
+		e := Errorf(CODE_WAGER_OUT_OF_RANGE, "invalid wager: must be at most %d cents, but got %d", uint64(MAX_WAGER_CENTS), p.WagerCents)
+		e.Details = map[string]any{"maxCents": uint64(MAX_WAGER_CENTS), "wagerCents": p.WagerCents}
+		return VerifyBetResult{}, e
 	}
-	// (6) Roll the dice
-	roll := Roll(serverSeed, []byte(p.ClientSeed))
-	// (7) Compute delta
-	var won bool
-	var underAmountCents uint64
-	if p.RollUnder {
-		won = roll < p.Threshold
-		underAmountCents = uint64(p.Threshold)
-	} else {
-		won = roll > p.Threshold
-		underAmountCents = 10000 - uint64(p.Threshold)
+	houseEdgePct := CurrentGameParams().HouseEdgePct
+	if p.HouseEdgePct != nil {
+		houseEdgePct = *p.HouseEdgePct
 	}
-	var deltaCents int64
-	if won {
-		// reward = wager * (10000 / underAmountCents) - wager
-		// Apply house edge
-		payout := (p.WagerCents * 10000 * (100 - HOUSE_EDGE_PCT)) / (underAmountCents * 100)
-		deltaCents = int64(payout) - int64(p.WagerCents)
-	} else {
-		deltaCents = -int64(p.WagerCents)
+	if houseEdgePct >= 100 {
+		return VerifyBetResult{}, Errorf(CODE_INVALID_REQUEST, "invalid house edge: must be below 100%%, but got %d%%", houseEdgePct)
+	}
+	ssHash, err := dice.HashServerSeed(p.ServerSeed)
+	if err != nil {
+		return VerifyBetResult{}, NewError(CODE_INVALID_REQUEST, err.Error())
 	}
 
-	// Ensure balance doesn't go negative
-	newBalance := int64(user.BalanceCents) + deltaCents
-	if newBalance < 0 {
-		newBalance = 0
+	version := uint8(dice.AlgorithmUnrecorded)
+	if p.AlgorithmVersion != nil {
+		version = *p.AlgorithmVersion
 	}
 
-	// (8) Atomically update database with new balance + server seed
-	newSeed := NewServerSeed()
-	updatedUser := User{
-		Id:           user.Id,
-		ServerSeed:   hex.EncodeToString(newSeed[:]),
-		BalanceCents: uint64(newBalance),
+	// (2) Roll + settle just like onBet
+	roll, err := dice.Roll(version, p.ServerSeed, p.ClientSeed, p.Nonce)
+	if err != nil {
+		return VerifyBetResult{}, NewError(CODE_INVALID_REQUEST, err.Error())
 	}
+	outcome := dice.Settle(p.WagerCents, p.RollUnder, p.Threshold, roll, houseEdgePct)
+	return VerifyBetResult{
+		ServerSeedHash: ssHash,
+		Result:         roll,
+		Won:            outcome.Won,
+		PayoutCents:    outcome.PayoutCents,
+		DeltaCents:     outcome.DeltaCents,
+	}, nil
+}
+
+type RotateSeedParams struct {
+	AuthData
+	ClientSeed string `json:"clientSeed"` // optional: client seed for the next pair
+}
 
-	err = DB.UserCompareExchange(user, updatedUser)
+type RotateSeedResult struct {
+	// The pair that was just retired, now fully revealed
+	ServerSeed     string `json:"serverSeed"`
+	ServerSeedHash string `json:"serverSeedHash"`
+	ClientSeed     string `json:"clientSeed"`
+	Nonce          uint64 `json:"nonce"`
+	// The pair that will be used for subsequent bets
+	NextServerSeedHash string `json:"nextServerSeedHash"`
+	NextClientSeed     string `json:"nextClientSeed"`
+}
+
+func onRotateSeed(p RotateSeedParams) (RotateSeedResult, error) {
+	// (1) Authenticate user
+	userId, err := Authenticate(p.AuthData, SCOPE_BET)
 	if err != nil {
-		return BetResult{}, err
+		return RotateSeedResult{}, err
 	}
 
-	// (9) Record the bet
-	bet := Bet{
-		UserId:      user.Id,
-		AmountCents: p.WagerCents,
-		RollUnder:   p.RollUnder,
-		Threshold:   p.Threshold,
-		Result:      roll,
-		Won:         won,
-		ServerSeed:  user.ServerSeed, // Use the old server seed for the bet record
-		CreatedAt:   uint64(time.Now().Unix()),
+	// (2) Validate new client seed
+	if p.ClientSeed != "" {
+		err = CurrentGameParams().ValidateClientSeed(p.ClientSeed)
+		if err != nil {
+			return RotateSeedResult{}, err
+		}
 	}
 
-	err = DB.BetCreate(bet)
+	// (3) Retire the old pair and create the next one,
+	// keeping the old client seed if none was provided
+	var sp, next SeedPair
+	err = DB.WithTx(func(tx *Tx) error {
+		var err error
+		sp, err = tx.SeedPairGetActive(userId)
+		if err != nil {
+			return err
+		}
+		clientSeed := p.ClientSeed
+		if clientSeed == "" {
+			clientSeed = sp.ClientSeed
+		}
+		next, err = tx.SeedPairRotate(sp, clientSeed)
+		return err
+	})
 	if err != nil {
-		log.Printf("Warning: Failed to record bet: %v", err)
+		return RotateSeedResult{}, err
 	}
 
-	// (10) Return result
-	return BetResult{
-		Won:        won,
-		DeltaCents: deltaCents,
-		ServerSeed: user.ServerSeed, // Return the server seed used for this bet
-		Result:     roll,
+	// (4) Reveal
+	ssHash, err := dice.HashServerSeed(sp.ServerSeed)
+	if err != nil {
+		return RotateSeedResult{}, err
+	}
+	nextHash, err := dice.HashServerSeed(next.ServerSeed)
+	if err != nil {
+		return RotateSeedResult{}, err
+	}
+	return RotateSeedResult{
+		ServerSeed:         sp.ServerSeed,
+		ServerSeedHash:     ssHash,
+		ClientSeed:         sp.ClientSeed,
+		Nonce:              sp.Nonce,
+		NextServerSeedHash: nextHash,
+		NextClientSeed:     next.ClientSeed,
 	}, nil
 }
 
 type DepositParams struct {
-	Message     string `json:"message"`
-	Signature   string `json:"signature"`
-	AmountCents uint64 `json:"amountCents"`
+	AuthData
+	AmountCents uint64 `json:"amountCents" schema:"required,minimum=1"`
 }
 
 type DepositResult struct {
@@ -248,14 +590,14 @@ type DepositResult struct {
 
 func onDeposit(p DepositParams) (DepositResult, error) {
 	// (1) Authenticate user
-	userId, err := VerifyMessageB58(GAME_ADDRESS, p.Message, p.Signature)
+	userId, err := Authenticate(p.AuthData, SCOPE_BET)
 	if err != nil {
 		return DepositResult{}, err
 	}
 
 	// (2) Validate amount
 	if p.AmountCents == 0 {
-		return DepositResult{}, errors.New("deposit amount must be greater than 0")
+		return DepositResult{}, NewError(CODE_INVALID_REQUEST, "deposit amount must be greater than 0")
 	}
 
 	// (3) Generate unique deposit ID
@@ -263,10 +605,11 @@ func onDeposit(p DepositParams) (DepositResult, error) {
 	depositId := hex.EncodeToString(depositIdBytes[:])
 
 	// (4) Generate deposit URL
-	depositUrl := fmt.Sprintf(IVY_URL+"/deposit?game=%s&id=%s", base58.Encode(GAME_ADDRESS[:]), depositId)
+	depositUrl := fmt.Sprintf(CONFIG.IvyUrl+"/deposit?game=%s&id=%s", base58.Encode(GAME_ADDRESS[:]), depositId)
 
 	// (5) Create deposit record in database
-	err = DB.DepositCreate(depositId, userId, depositUrl, p.AmountCents)
+	expiresAt := uint64(time.Now().Add(DEPOSIT_INTENT_TTL).Unix())
+	err = DB.DepositCreate(depositId, userId, depositUrl, p.AmountCents, expiresAt)
 	if err != nil {
 		return DepositResult{}, fmt.Errorf("failed to create deposit record: %v", err)
 	}
@@ -278,35 +621,32 @@ func onDeposit(p DepositParams) (DepositResult, error) {
 }
 
 type WithdrawParams struct {
-	Message     string `json:"message"`
-	Signature   string `json:"signature"`
-	AmountCents uint64 `json:"amountCents"`
+	AuthData
+	AmountCents uint64 `json:"amountCents" schema:"required,minimum=1"`
 }
 
 type WithdrawResult struct {
-	Id  string `json:"id"`
-	Url string `json:"url"`
+	Id        string `json:"id"`
+	Url       string `json:"url"`
+	ExpiresAt uint64 `json:"expiresAt"`
 }
 
 func onWithdraw(p WithdrawParams) (WithdrawResult, error) {
 	// (1) Authenticate user
-	userAddress, err := VerifyMessage(GAME_ADDRESS, p.Message, p.Signature)
+	userId, err := Authenticate(p.AuthData, SCOPE_WITHDRAW)
 	if err != nil {
 		return WithdrawResult{}, err
 	}
-
-	// (2) Get user and validate balance
-	user, err := DB.UserGet(base58.Encode(userAddress[:]))
-	if err != nil {
-		return WithdrawResult{}, err
+	var userAddress [32]byte
+	userBytes, err := base58.Decode(userId)
+	if err != nil || len(userBytes) != len(userAddress) {
+		return WithdrawResult{}, NewError(CODE_AUTH_INVALID, "invalid user address")
 	}
+	copy(userAddress[:], userBytes)
 
+	// (2) Validate amount
 	if p.AmountCents == 0 {
-		return WithdrawResult{}, errors.New("withdrawal amount must be greater than 0")
-	}
-
-	if p.AmountCents > user.BalanceCents {
-		return WithdrawResult{}, fmt.Errorf("insufficient balance: you have %d cents but trying to withdraw %d cents", user.BalanceCents, p.AmountCents)
+		return WithdrawResult{}, NewError(CODE_INVALID_REQUEST, "withdrawal amount must be greater than 0")
 	}
 
 	// (3) Generate unique withdraw ID
@@ -317,63 +657,86 @@ func onWithdraw(p WithdrawParams) (WithdrawResult, error) {
 	withdrawSignatureBytes := SignWithdrawal(GAME_ADDRESS, userAddress, withdrawId, WITHDRAW_AUTHORITY_PRIVATE_KEY)
 	withdrawSignature := hex.EncodeToString(withdrawSignatureBytes[:])
 
-	// (5) Update user balance atomically
-	updatedUser := User{
-		Id:           user.Id,
-		ServerSeed:   user.ServerSeed,
-		BalanceCents: user.BalanceCents - p.AmountCents,
-	}
-
-	err = DB.UserCompareExchange(user, updatedUser)
-	if err != nil {
-		return WithdrawResult{}, fmt.Errorf("failed to update user balance: %v", err)
-	}
-
-	// (6) Generate withdraw URL
+	// (5) Generate withdraw URL
 	withdrawUrl := fmt.Sprintf("%s/withdraw?game=%s&id=%s&signature=%s&user=%s",
-		IVY_URL, base58.Encode(GAME_ADDRESS[:]), hex.EncodeToString(withdrawId[:]), withdrawSignature, user.Id)
+		CONFIG.IvyUrl, base58.Encode(GAME_ADDRESS[:]), withdrawIdHex, withdrawSignature, userId)
 
-	// (7) Create withdrawal record in database
-	err = DB.WithdrawCreate(withdrawIdHex, user.Id, withdrawUrl, p.AmountCents, withdrawSignature)
+	// (6) Debit user + create withdrawal record, atomically
+	expiresAt := uint64(time.Now().Add(WITHDRAW_CLAIM_WINDOW).Unix())
+	err = DB.WithTx(func(tx *Tx) error {
+		user, err := tx.UserGet(userId)
+		if err != nil {
+			return err
+		}
+		if user.Frozen {
+			return ErrAccountFrozen
+		}
+		if p.AmountCents > user.BalanceCents {
+			e := Errorf(CODE_INSUFFICIENT_BALANCE, "insufficient balance: you have %d cents but trying to withdraw %d cents", user.BalanceCents, p.AmountCents)
+			e.Details = map[string]any{"balanceCents": user.BalanceCents, "amountCents": p.AmountCents}
+			return e
+		}
+		err = tx.WithdrawCreate(withdrawIdHex, user.Id, withdrawUrl, p.AmountCents, withdrawSignature, expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to create withdrawal record: %v", err)
+		}
+		_, err = tx.UserAdjust(user.Id, -int64(p.AmountCents), LEDGER_WITHDRAWAL, withdrawIdHex)
+		if err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		// Try to rollback the balance change
-		// Yes, I know that this is not secure against edge cases,
-		// but I'm too lazy to care :)
-		DB.UserCredit(user.Id, p.AmountCents)
-		return WithdrawResult{}, fmt.Errorf("failed to create withdrawal record: %v", err)
+		return WithdrawResult{}, err
 	}
 
 	return WithdrawResult{
-		Id:  withdrawIdHex,
-		Url: withdrawUrl,
+		Id:        withdrawIdHex,
+		Url:       withdrawUrl,
+		ExpiresAt: expiresAt,
 	}, nil
 }
 
 // Additional endpoints for checking deposit/withdrawal status
 type DepositStatusParams struct {
-	Message   string `json:"message"`
-	Signature string `json:"signature"`
-	DepositID string `json:"depositId"`
+	AuthData
+	DepositID string `json:"depositId" schema:"required,pattern=^[0-9a-f]{64}$"`
 }
 
-func onDepositStatus(p DepositStatusParams) (Deposit, error) {
+func onDepositStatus(ctx context.Context, p DepositStatusParams) (Deposit, error) {
 	// Authenticate user
-	userId, err := VerifyMessageB58(GAME_ADDRESS, p.Message, p.Signature)
+	userId, err := Authenticate(p.AuthData, SCOPE_READ)
 	if err != nil {
 		return Deposit{}, err
 	}
 
 	// Get deposit
 	deposit, err := DB.DepositGet(p.DepositID)
+	if err == sql.ErrNoRows {
+		return Deposit{}, NewError(CODE_NOT_FOUND, "deposit not found")
+	}
 	if err != nil {
 		return Deposit{}, err
 	}
 
 	// Verify user owns this deposit
 	if deposit.UserId != userId {
-		return Deposit{}, errors.New("deposit not owned by authenticated user")
+		return Deposit{}, NewError(CODE_FORBIDDEN, "deposit not owned by authenticated user")
 	}
 
+	updated, err := checkDeposit(ctx, deposit)
+	if errors.Is(err, ErrAggregatorUnavailable) {
+		// We can't confirm anything right now, so report what we know
+		deposit.ConfirmationDelayed = true
+		return deposit, nil
+	}
+	return updated, err
+}
+
+// Checks whether a pending (or expired) deposit has landed on-chain and, if so,
+// completes it and credits the user. Shared by `deposit_status` and the deposit
+// watcher; safe to call concurrently for the same deposit.
+func checkDeposit(ctx context.Context, deposit Deposit) (Deposit, error) {
 	// If completed, return deposit
 	if deposit.Completed {
 		return deposit, nil
@@ -384,7 +747,7 @@ func onDepositStatus(p DepositStatusParams) (Deposit, error) {
 	if err != nil {
 		return Deposit{}, err
 	}
-	depositInfo, err := FetchDepositInfo(AGGREGATOR_URL, GAME_ADDRESS, depositId)
+	depositInfo, err := AGGREGATOR.Deposit(ctx, GAME_ADDRESS, depositId)
 	if err != nil {
 		return Deposit{}, err
 	}
@@ -392,36 +755,164 @@ func onDepositStatus(p DepositStatusParams) (Deposit, error) {
 		// Not completed, return incomplete deposit
 		return deposit, nil
 	}
-	// Completed! let's complete it in db, then return updated deposit
-	err = DB.DepositComplete(deposit.Id, depositInfo.Signature, depositInfo.Timestamp)
+	return completeDeposit(deposit, *depositInfo)
+}
+
+// Marks a deposit as completed and credits the user, then returns the updated
+// deposit. Idempotent: completing an already-completed deposit does nothing.
+func completeDeposit(deposit Deposit, depositInfo DepositInfo) (Deposit, error) {
+	completed := false
+	err := DB.WithTx(func(tx *Tx) error {
+		current, err := tx.DepositGet(deposit.Id)
+		if err != nil {
+			return err
+		}
+		if current.Completed {
+			// someone else got here first
+			return nil
+		}
+		err = tx.DepositComplete(deposit.Id, depositInfo.Signature, depositInfo.Timestamp)
+		if err != nil {
+			return err
+		}
+		// the user may never have called `user_get`, so make sure they exist
+		_, err = tx.UserGet(deposit.UserId)
+		if err != nil {
+			return err
+		}
+		completed = true
+		return tx.UserCredit(deposit.UserId, deposit.AmountCents, LEDGER_DEPOSIT, deposit.Id)
+	})
 	if err != nil {
 		return Deposit{}, err
 	}
-	// Credit user
-	err = DB.UserCredit(deposit.UserId, deposit.AmountCents)
+	updated, err := DB.DepositGet(deposit.Id)
 	if err != nil {
-		// try to un-complete the deposit
-		// insecure against edge cases but I'm lazy :)
-		DB.DepositUncomplete(deposit.Id)
 		return Deposit{}, err
 	}
-	deposit, err = DB.DepositGet(deposit.Id)
+	if completed {
+		FEED.PublishDeposit(updated)
+		DEPOSIT_EVENTS.Publish(updated)
+	}
+	return updated, nil
+}
+
+type WithdrawStatusParams struct {
+	AuthData
+	WithdrawID string `json:"withdrawId" schema:"required,pattern=^[0-9a-f]{64}$"`
+}
+
+func onWithdrawStatus(ctx context.Context, p WithdrawStatusParams) (Withdrawal, error) {
+	// Authenticate user
+	userId, err := Authenticate(p.AuthData, SCOPE_READ)
 	if err != nil {
-		return Deposit{}, err
+		return Withdrawal{}, err
+	}
+
+	// Get withdrawal
+	withdrawal, err := DB.WithdrawGet(p.WithdrawID)
+	if err == sql.ErrNoRows {
+		return Withdrawal{}, NewError(CODE_NOT_FOUND, "withdrawal not found")
+	}
+	if err != nil {
+		return Withdrawal{}, err
+	}
+
+	// Verify user owns this withdrawal
+	if withdrawal.UserId != userId {
+		return Withdrawal{}, NewError(CODE_FORBIDDEN, "withdrawal not owned by authenticated user")
+	}
+
+	return checkWithdrawal(ctx, withdrawal)
+}
+
+// Checks whether a withdrawal that isn't completed yet has been claimed
+// on-chain and, if so, completes it. Expired withdrawals are checked too,
+// since the program can't stop them from being claimed (see
+// `completeWithdrawal`). Shared by `withdraw_status` and the sweeps.
+func checkWithdrawal(ctx context.Context, withdrawal Withdrawal) (Withdrawal, error) {
+	// If completed, return withdrawal
+	if withdrawal.Completed {
+		return withdrawal, nil
+	}
+
+	// Otherwise, fetch withdrawal state on blockchain
+	withdrawId, err := DecodeHex32(withdrawal.Id)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	withdrawInfo, err := AGGREGATOR.Withdrawal(ctx, GAME_ADDRESS, withdrawId)
+	if err != nil {
+		return Withdrawal{}, err
 	}
-	return deposit, nil
+	if withdrawInfo == nil {
+		// Not claimed yet, return incomplete withdrawal
+		return withdrawal, nil
+	}
+	// Claimed! let's complete it in db, then return updated withdrawal
+	return completeWithdrawal(withdrawal, *withdrawInfo)
+}
+
+// Marks a withdrawal as claimed, then returns the updated withdrawal.
+// Idempotent: completing an already-completed withdrawal does nothing.
+//
+// If the withdrawal had expired, the user was refunded but claimed it
+// anyway, so the refund is taken back. Whatever their balance can't
+// cover is still owed: their account is frozen, and `reconcile` reports
+// it, until an admin sorts it out.
+func completeWithdrawal(withdrawal Withdrawal, withdrawInfo WithdrawInfo) (Withdrawal, error) {
+	err := DB.WithTx(func(tx *Tx) error {
+		current, err := tx.WithdrawGet(withdrawal.Id)
+		if err != nil {
+			return err
+		}
+		if current.Completed {
+			// someone else got here first
+			return nil
+		}
+		err = tx.WithdrawComplete(withdrawal.Id, withdrawInfo.Signature, withdrawInfo.Timestamp)
+		if err != nil {
+			return err
+		}
+		if !current.Expired {
+			return nil
+		}
+
+		user, err := tx.UserGet(current.UserId)
+		if err != nil {
+			return err
+		}
+		clawbackCents := min(user.BalanceCents, current.AmountCents)
+		if clawbackCents > 0 {
+			_, err = tx.UserAdjust(user.Id, -int64(clawbackCents), LEDGER_WITHDRAWAL_CLAWBACK, current.Id)
+			if err != nil {
+				return err
+			}
+		}
+		if clawbackCents < current.AmountCents {
+			err = tx.UserSetFrozen(user.Id, true)
+			if err != nil {
+				return err
+			}
+		}
+		log.Printf("Withdrawal %s was claimed after it expired: took back %d of %d cents from %s", current.Id, clawbackCents, current.AmountCents, user.Id)
+		return nil
+	})
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	return DB.WithdrawGet(withdrawal.Id)
 }
 
 // List endpoints
 type ListParams struct {
-	Message   string `json:"message"`
-	Signature string `json:"signature"`
-	Count     int    `json:"count"`
-	Skip      int    `json:"skip"`
+	AuthData
+	Count int `json:"count"`
+	Skip  int `json:"skip" schema:"minimum=0"`
 }
 
 func onBetList(p ListParams) ([]Bet, error) {
-	userId, err := VerifyMessageB58(GAME_ADDRESS, p.Message, p.Signature)
+	userId, err := Authenticate(p.AuthData, SCOPE_READ)
 	if err != nil {
 		return nil, err
 	}
@@ -433,8 +924,50 @@ func onBetList(p ListParams) ([]Bet, error) {
 	return DB.BetList(userId, p.Count, p.Skip)
 }
 
+type BetPageParams struct {
+	AuthData
+	Count  int    `json:"count"`
+	Cursor string `json:"cursor" schema:"pattern=^[0-9]*$"` // `nextCursor` of the previous page, or empty for the newest bets
+}
+
+type BetPage struct {
+	Bets       []Bet  `json:"bets"`
+	NextCursor string `json:"nextCursor"` // empty if there are no more bets
+}
+
+func onBetPage(p BetPageParams) (BetPage, error) {
+	userId, err := Authenticate(p.AuthData, SCOPE_READ)
+	if err != nil {
+		return BetPage{}, err
+	}
+
+	if p.Count <= 0 || p.Count > 100 {
+		p.Count = 20 // Default
+	}
+	// the cursor is the ID of the last bet on the previous page
+	beforeId := uint64(math.MaxInt64)
+	if p.Cursor != "" {
+		beforeId, err = strconv.ParseUint(p.Cursor, 10, 63)
+		if err != nil {
+			return BetPage{}, NewError(CODE_INVALID_REQUEST, "invalid cursor")
+		}
+	}
+
+	bets, err := DB.BetListBefore(userId, beforeId, p.Count)
+	if err != nil {
+		return BetPage{}, err
+	}
+	page := BetPage{
+		Bets: bets,
+	}
+	if len(bets) == p.Count {
+		page.NextCursor = strconv.FormatUint(bets[len(bets)-1].Id, 10)
+	}
+	return page, nil
+}
+
 func onDepositList(p ListParams) ([]Deposit, error) {
-	userId, err := VerifyMessageB58(GAME_ADDRESS, p.Message, p.Signature)
+	userId, err := Authenticate(p.AuthData, SCOPE_READ)
 	if err != nil {
 		return nil, err
 	}
@@ -447,7 +980,7 @@ func onDepositList(p ListParams) ([]Deposit, error) {
 }
 
 func onWithdrawList(p ListParams) ([]Withdrawal, error) {
-	userId, err := VerifyMessageB58(GAME_ADDRESS, p.Message, p.Signature)
+	userId, err := Authenticate(p.AuthData, SCOPE_READ)
 	if err != nil {
 		return nil, err
 	}
@@ -459,114 +992,182 @@ func onWithdrawList(p ListParams) ([]Withdrawal, error) {
 	return DB.WithdrawList(userId, p.Count, p.Skip)
 }
 
-func onRequest(body []byte) (any, error) {
-	type AnyRequest struct {
-		Action string `json:"action"`
-	}
-	var ar AnyRequest
-	err := json.Unmarshal(body, &ar)
+func onBalanceHistory(p ListParams) ([]LedgerEntry, error) {
+	userId, err := Authenticate(p.AuthData, SCOPE_READ)
 	if err != nil {
 		return nil, err
 	}
-	a := ar.Action
-	switch a {
-	case "ping":
-		type PingResponse struct {
-			Response string `json:"response"`
-		}
+
+	if p.Count <= 0 || p.Count > 100 {
+		p.Count = 20 // Default
+	}
+
+	return DB.LedgerList(userId, p.Count, p.Skip)
+}
+
+type PingResponse struct {
+	Response string `json:"response"`
+}
+
+type MaxBetResponse struct {
+	MaxBetCents uint64 `json:"maxBetCents"`
+}
+
+// Every action callable through `POST /`, in the order they're documented
+var ACTIONS = []Action{
+	NewAction("ping", "Check that the server is up", func(context.Context, struct{}) (PingResponse, error) {
 		return PingResponse{
 			Response: "pong",
 		}, nil
-
-	case "max_bet":
-		type MaxBetResponse struct {
-			MaxBetCents uint64 `json:"maxBetCents"`
-		}
+	}),
+	NewAction("max_bet", "Get the maximum wager", func(context.Context, struct{}) (MaxBetResponse, error) {
 		return MaxBetResponse{
-			MaxBetCents: MAX_BET_CENTS,
+			MaxBetCents: CurrentGameParams().MaxBetCents,
 		}, nil
+	}),
+	NewAction("login", "Exchange a signed auth message for a session token", withoutContext(onLogin)),
+	NewAction("logout", "Revoke a session token", withoutContext(onLogout)),
+	NewAction("revoke_sessions", "Revoke all session tokens, signed auth messages and API keys", withoutContext(onRevokeSessions)),
+	NewAction("api_key_create", "Create an API key", withoutContext(onApiKeyCreate)),
+	NewAction("api_key_list", "List API keys", withoutContext(onApiKeyList)),
+	NewAction("api_key_revoke", "Revoke an API key", withoutContext(onApiKeyRevoke)),
+	NewAction("game_params", "Get the current game parameters", func(context.Context, struct{}) (GameParams, error) {
+		return onGameParams()
+	}),
+	NewAction("set_game_params", "Change the game parameters (admins only)", withoutContext(onSetGameParams)),
+	NewAction("user_get", "Get the authenticated user", withoutContext(onUserGet)),
+	NewAction("bet", "Place a bet", withoutContext(onBet)),
+	NewAction("bet_batch", "Place several bets in a row, stopping early at a loss or profit limit", withoutContext(onBetBatch)),
+	NewAction("verify_bet", "Recompute a bet from its revealed seeds", withoutContext(onVerifyBet)),
+	NewAction("rotate_seed", "Reveal the current seed pair and start a new one", withoutContext(onRotateSeed)),
+	NewAction("deposit", "Create a deposit", withoutContext(onDeposit)),
+	NewAction("withdraw", "Create a withdrawal", withoutContext(onWithdraw)),
+	NewAction("deposit_status", "Get a deposit, completing it if it has been paid", onDepositStatus),
+	NewAction("withdraw_status", "Get a withdrawal, completing it if it has been claimed", onWithdrawStatus),
+	NewAction("bet_list", "List bets", withoutContext(onBetList)),
+	NewAction("bet_page", "List bets, a page at a time", withoutContext(onBetPage)),
+	NewAction("deposit_list", "List deposits", withoutContext(onDepositList)),
+	NewAction("withdraw_list", "List withdrawals", withoutContext(onWithdrawList)),
+	NewAction("balance_history", "List balance movements", withoutContext(onBalanceHistory)),
+}
 
-	case "user_get":
-		var p UserGetParams
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			return nil, err
-		}
-		return onUserGet(p)
+// Dispatches a `POST /` request body to its action
+func onRequest(ctx context.Context, body []byte) (any, error) {
+	// (1) Parse the request
+	request, err := DecodeRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := request.(map[string]any)
+	if !ok {
+		return nil, NewError(CODE_INVALID_REQUEST, "invalid request: must be an object")
+	}
 
-	case "bet":
-		var p BetParams
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			return nil, err
-		}
-		return onBet(p)
+	// (2) Find + call the action
+	name, _ := fields["action"].(string)
+	a := FindAction(name)
+	if a == nil {
+		e := Errorf(CODE_UNKNOWN_ACTION, "unknown action %s", name)
+		e.Details = map[string]any{"action": name}
+		return nil, e
+	}
+	return a.Call(ctx, request, a.RequestSchema)
+}
 
-	case "deposit":
-		var p DepositParams
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			return nil, err
-		}
-		return onDeposit(p)
+func main() {
+	GAME_ADDRESS = MustDecodeBase58PublicKey(os.Getenv("GAME"))
+	WITHDRAW_AUTHORITY_PRIVATE_KEY = MustDecodeHexPrivateKey(os.Getenv("WITHDRAW_AUTHORITY_PRIVATE_KEY"))
 
-	case "withdraw":
-		var p WithdrawParams
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			return nil, err
-		}
-		return onWithdraw(p)
+	var err error
+	var args []string
+	CONFIG, args, err = LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	case "deposit_status":
-		var p DepositStatusParams
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			return nil, err
-		}
-		return onDepositStatus(p)
+	// Take the write lock at the start of each transaction, and wait
+	// for it instead of failing immediately with SQLITE_BUSY
+	db, err := sql.Open("sqlite3", CONFIG.DbPath+"?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		log.Fatal(err)
+	}
+	DB = NewDatabase(db)
+	DB.OnLedgerEntry = FEED.PublishLedgerEntry
+	err = DB.Startup()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	case "bet_list":
-		var p ListParams
-		err = json.Unmarshal(body, &p)
-		if err != nil {
-			return nil, err
-		}
-		return onBetList(p)
+	_, err = LoadGameParams(CONFIG.Game)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	case "deposit_list":
-		var p ListParams
-		err = json.Unmarshal(body, &p)
+	if len(args) > 0 {
+		err = runCommand(args[0], args[1:])
 		if err != nil {
-			return nil, err
+			log.Fatal(err)
 		}
-		return onDepositList(p)
+		return
+	}
 
-	case "withdraw_list":
-		var p ListParams
-		err = json.Unmarshal(body, &p)
+	aggregatorUrl := CONFIG.AggregatorUrl
+	// The aggregator's key for signing deposit webhooks, if it sends them
+	var webhookKey *[32]byte
+	if k := os.Getenv("AGGREGATOR_WEBHOOK_PUBLIC_KEY"); k != "" {
+		key := MustDecodeBase58PublicKey(k)
+		webhookKey = &key
+	}
+	if addr := os.Getenv("FAKE_AGGREGATOR"); addr != "" {
+		// run against an in-process fake, for local development
+		aggregatorUrl, webhookKey, err = useFakeAggregator(addr, webhookKey)
 		if err != nil {
-			return nil, err
+			log.Fatal(err)
 		}
-		return onWithdrawList(p)
-
-	default:
-		return nil, fmt.Errorf("unknown action %s", ar.Action)
 	}
-}
-
-func main() {
-	var err error
-	db, err := sql.Open("sqlite3", DB_PATH)
-	if err != nil {
-		log.Fatal(err)
+	AGGREGATOR = NewResilientAggregator(NewHTTPAggregator(aggregatorUrl, AGGREGATOR_TIMEOUT))
+
+	// Sign session tokens with a fixed key, so that they survive restarts.
+	// Local development against the fake aggregator may use a random one.
+	sessionKey := NewSessionKey()
+	if k := os.Getenv("SESSION_KEY"); k != "" {
+		sessionKey, err = hex.DecodeString(k)
+		if err != nil || len(sessionKey) < 32 {
+			log.Fatal("SESSION_KEY must be at least 32 hex-encoded bytes")
+		}
+	} else if os.Getenv("FAKE_AGGREGATOR") == "" {
+		log.Fatal("SESSION_KEY must be set (e.g. to the output of `openssl rand -hex 32`)")
 	}
-	DB = Database{db}
-	err = DB.Startup()
+	SESSIONS, err = NewSessions(sessionKey)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Reload the game parameters on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := ReloadGameParams()
+			if err != nil {
+				log.Printf("Can't reload game parameters: %v", err)
+			}
+		}
+	}()
+
+	go runEvery(WITHDRAW_SWEEP_INTERVAL, sweepWithdrawals)
+	go runEvery(WITHDRAW_LATE_CLAIM_INTERVAL, checkRefundedWithdrawals)
+	go runEvery(DEPOSIT_WATCH_INTERVAL, watchDeposits)
+	go runEvery(DEPOSIT_SWEEP_INTERVAL, sweepDeposits)
+	go runEvery(SESSION_PRUNE_INTERVAL, SESSIONS.Prune)
+
+	if webhookKey != nil {
+		http.HandleFunc("/webhooks/deposit", DepositWebhookHandler(*webhookKey))
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -578,34 +1179,28 @@ func main() {
 		}
 
 		if r.Method != "POST" {
-			http.Error(w, `{"error":"method not allowed"}`, 405)
+			writeError(w, NewError(CODE_METHOD_NOT_ALLOWED, "method not allowed"))
 			return
 		}
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, `{"error":"can't read body"}`, 500)
+			writeError(w, NewError(CODE_INVALID_REQUEST, "can't read body"))
 			return
 		}
 
-		data, err := onRequest(body)
+		data, err := onRequest(r.Context(), body)
 		if err != nil {
-			text, errMarshal := json.Marshal(ErrorResponse{
-				Error: err.Error(),
-			})
-			if errMarshal != nil {
-				text = []byte(`{"error":"can't serialize error response"}`)
-			}
-			http.Error(w, string(text), 400)
+			writeError(w, err)
 			return
 		}
-
-		err = json.NewEncoder(w).Encode(data)
-		if err != nil {
-			log.Printf("Error encoding response: %v", err)
-		}
+		writeJSON(w, 200, data)
 	})
+	RegisterRestRoutes(http.DefaultServeMux)
+	http.HandleFunc("GET /openapi.json", OpenAPIHandler())
+	http.HandleFunc("GET /ws", FEED.Handler())
+	http.HandleFunc("GET /v1/deposits/{id}/events", DEPOSIT_EVENTS.Handler())
 
-	log.Println("Listening on port", PORT)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(PORT), nil))
+	log.Println("Listening on port", CONFIG.Port)
+	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(CONFIG.Port), nil))
 }
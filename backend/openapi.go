@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const OPENAPI_VERSION = "3.0.3"
+const API_TITLE = "Ivy Dice API"
+const API_VERSION = "1"
+
+// Builds the OpenAPI document for `ACTIONS` and `REST_ROUTES`. Named Go
+// types become component schemas, so generated clients get one type per
+// struct.
+func BuildOpenAPI() map[string]any {
+	b := openapiBuilder{
+		components: map[string]*Schema{},
+	}
+
+	// (1) `POST /`: one request schema per action, told apart by `action`
+	var requests, results []*Schema
+	mapping := map[string]string{}
+	actions := map[string]any{}
+	for _, a := range ACTIONS {
+		request := b.ref(a.RequestSchema)
+		result := b.ref(SchemaOf(a.Result, true))
+		requests = append(requests, request)
+		if !slices.ContainsFunc(results, func(s *Schema) bool { return sameSchema(s, result) }) {
+			results = append(results, result)
+		}
+		mapping[a.Name] = request.Ref
+		actions[a.Name] = map[string]any{
+			"summary": a.Summary,
+			"request": request,
+			"result":  result,
+		}
+	}
+	paths := map[string]any{
+		"/": map[string]any{
+			"post": map[string]any{
+				"operationId": "action",
+				"summary":     "Call an action",
+				"description": "Calls the action named by the `action` field. The result of each action is listed under `x-actions`.",
+				"requestBody": map[string]any{
+					"required": true,
+					"content": jsonContent(&Schema{
+						OneOf: requests,
+						Discriminator: map[string]any{
+							"propertyName": "action",
+							"mapping":      mapping,
+						},
+					}),
+				},
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "The result of the action",
+						"content":     jsonContent(&Schema{OneOf: results}),
+					},
+					"default": errorResponse(),
+				},
+			},
+		},
+	}
+
+	// (2) The REST routes
+	security := []map[string][]string{
+		{"bearer": {}},
+		{"authMessage": {}, "authSignature": {}},
+	}
+	for _, route := range REST_ROUTES {
+		a := FindAction(route.Action)
+		op := map[string]any{
+			"operationId": route.OperationId,
+			"summary":     a.Summary,
+			"description": "Equivalent to the `" + a.Name + "` action.",
+			"responses": map[string]any{
+				strconv.Itoa(route.Status): map[string]any{
+					"description": "Success",
+					"content":     jsonContent(b.ref(SchemaOf(a.Result, true))),
+				},
+				"default": errorResponse(),
+			},
+		}
+		if _, ok := a.ParamsSchema.Properties["token"]; ok {
+			op["security"] = security
+		}
+		var parameters []map[string]any
+		for _, wildcard := range slices.Sorted(maps.Keys(route.PathParams)) {
+			parameters = append(parameters, map[string]any{
+				"name":     wildcard,
+				"in":       "path",
+				"required": true,
+				"schema":   b.ref(a.ParamsSchema.Properties[route.PathParams[wildcard]]),
+			})
+		}
+		for _, name := range route.Query {
+			parameters = append(parameters, map[string]any{
+				"name":   name,
+				"in":     "query",
+				"schema": b.ref(a.ParamsSchema.Properties[name]),
+			})
+		}
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+		if route.Body {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  jsonContent(b.ref(route.BodySchema(a))),
+			}
+		}
+		path, _ := paths[route.Path].(map[string]any)
+		if path == nil {
+			path = map[string]any{}
+			paths[route.Path] = path
+		}
+		path[strings.ToLower(route.Method)] = op
+	}
+
+	// (3) Streams, which aren't actions
+	paths["/v1/deposits/{id}/events"] = map[string]any{
+		"get": map[string]any{
+			"operationId": "streamDeposit",
+			"summary":     "Wait for a deposit to complete",
+			"description": "A Server-Sent Events stream of `deposit` events, whose data is the `Deposit` as JSON. The first event holds its current state; if that isn't completed or expired, a second one is sent once it is, and the stream ends. Streams also end after 10 minutes, so clients should reconnect.",
+			"security":    security,
+			"parameters": []map[string]any{{
+				"name":     "id",
+				"in":       "path",
+				"required": true,
+				"schema":   b.ref(FindAction("deposit_status").ParamsSchema.Properties["depositId"]),
+			}},
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "The event stream",
+					"content": map[string]any{
+						"text/event-stream": map[string]any{
+							"schema": &Schema{Type: "string"},
+						},
+					},
+				},
+				"default": errorResponse(),
+			},
+		},
+	}
+
+	// (4) Errors
+	codes := slices.Sorted(maps.Keys(ERROR_STATUSES))
+	errorSchema := SchemaOf(reflect.TypeFor[ErrorResponse](), true)
+	errorSchema.Properties["code"].Enum = make([]any, len(codes))
+	for i, code := range codes {
+		errorSchema.Properties["code"].Enum[i] = code
+	}
+	b.ref(errorSchema)
+
+	return map[string]any{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]any{
+			"title":   API_TITLE,
+			"version": API_VERSION,
+		},
+		"paths":     paths,
+		"x-actions": actions,
+		"components": map[string]any{
+			"schemas": b.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A session token from `login`, or an API key",
+				},
+				"authMessage": map[string]any{
+					"type": "apiKey",
+					"in":   "header",
+					"name": REST_MESSAGE_HEADER,
+				},
+				"authSignature": map[string]any{
+					"type": "apiKey",
+					"in":   "header",
+					"name": REST_SIGNATURE_HEADER,
+				},
+			},
+		},
+	}
+}
+
+type openapiBuilder struct {
+	components map[string]*Schema
+}
+
+// Returns a copy of `s` where every named struct has been replaced by
+// a reference to its component schema
+func (b *openapiBuilder) ref(s *Schema) *Schema {
+	c := *s
+	c.Properties = nil
+	for name, prop := range s.Properties {
+		if c.Properties == nil {
+			c.Properties = map[string]*Schema{}
+		}
+		c.Properties[name] = b.ref(prop)
+	}
+	if s.Items != nil {
+		c.Items = b.ref(s.Items)
+	}
+	if additional, ok := s.AdditionalProperties.(*Schema); ok {
+		c.AdditionalProperties = b.ref(additional)
+	}
+	c.AllOf = nil
+	for _, sub := range s.AllOf {
+		c.AllOf = append(c.AllOf, b.ref(sub))
+	}
+	if s.name == "" {
+		return &c
+	}
+
+	// a type may only have one schema, so the same struct
+	// can't be used both as parameters and as a result
+	if existing, ok := b.components[s.name]; ok && !sameSchema(existing, &c) {
+		panic("conflicting schemas for type " + s.name)
+	}
+	b.components[s.name] = &c
+	return &Schema{Ref: "#/components/schemas/" + s.name}
+}
+
+func sameSchema(a *Schema, b *Schema) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+func jsonContent(s *Schema) map[string]any {
+	return map[string]any{
+		"application/json": map[string]any{
+			"schema": s,
+		},
+	}
+}
+
+func errorResponse() map[string]any {
+	return map[string]any{
+		"description": "An error, with the HTTP status of its code",
+		"content":     jsonContent(&Schema{Ref: "#/components/schemas/ErrorResponse"}),
+	}
+}
+
+// Serves the OpenAPI document, which is built once up front
+func OpenAPIHandler() http.HandlerFunc {
+	document, err := json.Marshal(BuildOpenAPI())
+	if err != nil {
+		log.Fatalf("Can't build OpenAPI document: %v", err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(document)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+// End-to-end tests of deposits and withdrawals: actions are called the way
+// `POST /` calls them, against a fresh database and the fake aggregator.
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivypowered/ivy-dice/backend/client"
+	"github.com/mr-tron/base58"
+)
+
+type testBackend struct {
+	fake *FakeAggregator
+	key  ed25519.PrivateKey // the test user's
+	user string
+}
+
+// Sets up the backend's globals for a test, with a single user
+func startTestBackend(t *testing.T) *testBackend {
+	t.Helper()
+	// (1) Keys
+	game, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	GAME_ADDRESS = [32]byte(game)
+	_, authority, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	WITHDRAW_AUTHORITY_PRIVATE_KEY = [64]byte(authority)
+
+	// (2) Database
+	CONFIG = DefaultConfig()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "backend.db")+"?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	DB = NewDatabase(db)
+	err = DB.Startup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadGameParams(CONFIG.Game)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SESSIONS, err = NewSessions(NewSessionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// (3) Aggregator, without the resilient wrapper, whose
+	// cache would hide on-chain activity for a few seconds
+	fake, err := StartFakeAggregator("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+	AGGREGATOR = NewHTTPAggregator(fake.Url, AGGREGATOR_TIMEOUT)
+
+	// (4) User
+	public, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testBackend{fake: fake, key: key, user: base58.Encode(public)}
+}
+
+// Calls `action` as the test user, decoding its result into `result`
+func (b *testBackend) call(action string, params map[string]any, result any) error {
+	now := uint64(time.Now().Unix())
+	message := client.AuthMessage(b.key.Public().(ed25519.PublicKey), GAME_ADDRESS, now, now+3600)
+	request := map[string]any{
+		"action":    action,
+		"message":   message,
+		"signature": client.SignAuthMessage(b.key, message),
+	}
+	for k, v := range params {
+		request[k] = v
+	}
+	return callAnonymous(action, request, result)
+}
+
+// Calls `action` without authenticating, decoding its result into `result`
+func callAnonymous(action string, params map[string]any, result any) error {
+	request := map[string]any{"action": action}
+	for k, v := range params {
+		request[k] = v
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	data, err := onRequest(context.Background(), body)
+	if err != nil {
+		return err
+	}
+	// go through JSON, just like the response would
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, result)
+}
+
+// Like `call`, but fails the test on error
+func (b *testBackend) mustCall(t *testing.T, action string, params map[string]any, result any) {
+	t.Helper()
+	err := b.call(action, params, result)
+	if err != nil {
+		t.Fatalf("%s: %v", action, err)
+	}
+}
+
+func (b *testBackend) balance(t *testing.T) uint64 {
+	t.Helper()
+	var user UserClient
+	b.mustCall(t, "user_get", nil, &user)
+	return user.BalanceCents
+}
+
+// Gives the test user `amountCents`, like the `adjust` command
+func (b *testBackend) fund(t *testing.T, amountCents int64) {
+	t.Helper()
+	b.balance(t) // creates the user
+	err := DB.WithTx(func(tx *Tx) error {
+		_, err := tx.UserAdjust(b.user, amountCents, LEDGER_ADJUSTMENT, "test")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustDecodeHex32(t *testing.T, s string) [32]byte {
+	t.Helper()
+	id, err := DecodeHex32(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func assertCode(t *testing.T, err error, code ErrorCode) {
+	t.Helper()
+	var e *Error
+	if !errors.As(err, &e) || e.Code != code {
+		t.Fatalf("expected a %s error, got %v", code, err)
+	}
+}
+
+func TestDepositCompletesOncePaid(t *testing.T) {
+	b := startTestBackend(t)
+
+	var deposit DepositResult
+	b.mustCall(t, "deposit", map[string]any{"amountCents": 500}, &deposit)
+	var status Deposit
+	b.mustCall(t, "deposit_status", map[string]any{"depositId": deposit.Id}, &status)
+	if status.Completed {
+		t.Fatal("deposit completed before it was paid")
+	}
+
+	b.fake.PayDeposit(mustDecodeHex32(t, deposit.Id))
+	b.mustCall(t, "deposit_status", map[string]any{"depositId": deposit.Id}, &status)
+	if !status.Completed {
+		t.Fatal("paid deposit wasn't completed")
+	}
+	// checking again must not credit it twice
+	b.mustCall(t, "deposit_status", map[string]any{"depositId": deposit.Id}, &status)
+	if balance := b.balance(t); balance != 500 {
+		t.Fatalf("expected a balance of 500, got %d", balance)
+	}
+}
+
+func TestDepositCompletesByWebhook(t *testing.T) {
+	b := startTestBackend(t)
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(DepositWebhookHandler([32]byte(public)))
+	defer server.Close()
+	b.fake.WebhookUrl = server.URL
+	b.fake.WebhookKey = private
+	b.fake.Game = GAME_ADDRESS
+
+	var deposit DepositResult
+	b.mustCall(t, "deposit", map[string]any{"amountCents": 250}, &deposit)
+	completed, unsubscribe := DEPOSIT_EVENTS.Subscribe(deposit.Id)
+	defer unsubscribe()
+	b.fake.PayDeposit(mustDecodeHex32(t, deposit.Id))
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook didn't complete the deposit")
+	}
+	if balance := b.balance(t); balance != 250 {
+		t.Fatalf("expected a balance of 250, got %d", balance)
+	}
+}
+
+func TestDepositWatcherBacksOff(t *testing.T) {
+	b := startTestBackend(t)
+
+	var deposit DepositResult
+	b.mustCall(t, "deposit", map[string]any{"amountCents": 300}, &deposit)
+	checkDelay := func() (delay uint64) {
+		t.Helper()
+		err := DB.QueryRow(`SELECT checkDelay FROM deposits WHERE id = ?`, deposit.Id).Scan(&delay)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return delay
+	}
+	watchDeposits()
+	if delay := checkDelay(); delay != uint64(DEPOSIT_WATCH_INTERVAL.Seconds()) {
+		t.Fatalf("expected a delay of %v after the first check, got %ds", DEPOSIT_WATCH_INTERVAL, delay)
+	}
+	// still backing off, so it isn't checked again
+	watchDeposits()
+	if delay := checkDelay(); delay != uint64(DEPOSIT_WATCH_INTERVAL.Seconds()) {
+		t.Fatalf("deposit was checked while backing off, delay is now %ds", delay)
+	}
+
+	b.fake.PayDeposit(mustDecodeHex32(t, deposit.Id))
+	_, err := DB.Exec(`UPDATE deposits SET checkAt = 0 WHERE id = ?`, deposit.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchDeposits()
+	if balance := b.balance(t); balance != 300 {
+		t.Fatalf("watcher didn't credit the paid deposit, balance is %d", balance)
+	}
+}
+
+func TestDepositStreamEndsOnExpiry(t *testing.T) {
+	b := startTestBackend(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/deposits/{id}/events", DEPOSIT_EVENTS.Handler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var deposit DepositResult
+	b.mustCall(t, "deposit", map[string]any{"amountCents": 500}, &deposit)
+	var login LoginResult
+	b.mustCall(t, "login", nil, &login)
+	req, err := http.NewRequest("GET", server.URL+"/v1/deposits/"+deposit.Id+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	_, err = DB.Exec(`UPDATE deposits SET expiresAt = 1 WHERE id = ?`, deposit.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sweepDeposits()
+	done := make(chan []byte)
+	go func() {
+		body, _ := io.ReadAll(res.Body)
+		done <- body
+	}()
+	select {
+	case body := <-done:
+		if !strings.Contains(string(body), `"expired":true`) {
+			t.Fatalf("stream ended without the expiry: %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream didn't end once the deposit expired")
+	}
+}
+
+func TestWithdrawCompletesOnceClaimed(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 1000)
+
+	err := b.call("withdraw", map[string]any{"amountCents": 1001}, &WithdrawResult{})
+	assertCode(t, err, CODE_INSUFFICIENT_BALANCE)
+
+	var withdrawal WithdrawResult
+	b.mustCall(t, "withdraw", map[string]any{"amountCents": 600}, &withdrawal)
+	if balance := b.balance(t); balance != 400 {
+		t.Fatalf("expected a balance of 400, got %d", balance)
+	}
+	var status Withdrawal
+	b.mustCall(t, "withdraw_status", map[string]any{"withdrawId": withdrawal.Id}, &status)
+	if status.Completed {
+		t.Fatal("withdrawal completed before it was claimed")
+	}
+
+	b.fake.ClaimWithdrawal(mustDecodeHex32(t, withdrawal.Id))
+	b.mustCall(t, "withdraw_status", map[string]any{"withdrawId": withdrawal.Id}, &status)
+	if !status.Completed || status.ClaimSignature == "" {
+		t.Fatal("claimed withdrawal wasn't completed")
+	}
+	if balance := b.balance(t); balance != 400 {
+		t.Fatalf("expected a balance of 400, got %d", balance)
+	}
+}
+
+// Expires the test user's withdrawal, as if its claim window had passed
+func expireWithdrawal(t *testing.T, id string) {
+	t.Helper()
+	_, err := DB.Exec(`UPDATE withdrawals SET expiresAt = 1 WHERE id = ?`, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sweepWithdrawals()
+}
+
+func TestWithdrawRefundedThenClaimedLate(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 1000)
+
+	var withdrawal WithdrawResult
+	b.mustCall(t, "withdraw", map[string]any{"amountCents": 600}, &withdrawal)
+	expireWithdrawal(t, withdrawal.Id)
+	var status Withdrawal
+	b.mustCall(t, "withdraw_status", map[string]any{"withdrawId": withdrawal.Id}, &status)
+	if !status.Expired || status.Url != "" {
+		t.Fatal("unclaimed withdrawal wasn't expired")
+	}
+	if balance := b.balance(t); balance != 1000 {
+		t.Fatalf("expected a refund to 1000, got %d", balance)
+	}
+
+	// The signed URL still works on-chain, so the refund is taken back
+	b.fake.ClaimWithdrawal(mustDecodeHex32(t, withdrawal.Id))
+	checkRefundedWithdrawals()
+	b.mustCall(t, "withdraw_status", map[string]any{"withdrawId": withdrawal.Id}, &status)
+	if !status.Completed {
+		t.Fatal("late claim wasn't recorded")
+	}
+	if balance := b.balance(t); balance != 400 {
+		t.Fatalf("expected the refund to be taken back, leaving 400, got %d", balance)
+	}
+	user, err := DB.UserGet(b.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Frozen {
+		t.Fatal("account was frozen, but it covered the refund")
+	}
+}
+
+func TestWithdrawClaimedLateFreezesIfSpent(t *testing.T) {
+	b := startTestBackend(t)
+	b.fund(t, 1000)
+
+	var withdrawal WithdrawResult
+	b.mustCall(t, "withdraw", map[string]any{"amountCents": 600}, &withdrawal)
+	expireWithdrawal(t, withdrawal.Id)
+	b.fund(t, -900) // spend most of the refund
+
+	b.fake.ClaimWithdrawal(mustDecodeHex32(t, withdrawal.Id))
+	var status Withdrawal
+	b.mustCall(t, "withdraw_status", map[string]any{"withdrawId": withdrawal.Id}, &status)
+	if !status.Completed {
+		t.Fatal("late claim wasn't recorded")
+	}
+	user, err := DB.UserGet(b.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.BalanceCents != 0 || !user.Frozen {
+		t.Fatalf("expected an empty, frozen account, got %+v", user)
+	}
+	err = b.call("withdraw", map[string]any{"amountCents": 1}, &WithdrawResult{})
+	assertCode(t, err, CODE_ACCOUNT_FROZEN)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58"
+)
+
+// Returned while the aggregator is considered down, either because the
+// circuit breaker is open or because every retry failed
+var ErrAggregatorUnavailable = NewError(CODE_UPSTREAM_UNAVAILABLE, "aggregator unavailable")
+
+// Wraps an `Aggregator` with per-attempt deadlines, bounded retries, a
+// circuit breaker and a short-lived cache of answers.
+//
+// After `BreakerThreshold` consecutive failed calls the breaker opens and
+// calls fail fast with `ErrAggregatorUnavailable` for `BreakerCooldown`.
+// After that a single probe call is let through: if it succeeds the
+// breaker closes, otherwise it stays open for another cooldown.
+type ResilientAggregator struct {
+	Inner            Aggregator
+	AttemptTimeout   time.Duration
+	Retries          int
+	RetryDelay       time.Duration
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	CacheTTL         time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+	cache     map[string]aggregatorCacheEntry
+}
+
+type aggregatorCacheEntry struct {
+	value     any
+	expiresAt time.Time
+}
+
+// Drop expired cache entries once the cache grows past this size
+const AGGREGATOR_CACHE_PRUNE_SIZE = 1024
+
+func NewResilientAggregator(inner Aggregator) *ResilientAggregator {
+	return &ResilientAggregator{
+		Inner:            inner,
+		AttemptTimeout:   AGGREGATOR_TIMEOUT,
+		Retries:          AGGREGATOR_RETRIES,
+		RetryDelay:       AGGREGATOR_RETRY_DELAY,
+		BreakerThreshold: AGGREGATOR_BREAKER_THRESHOLD,
+		BreakerCooldown:  AGGREGATOR_BREAKER_COOLDOWN,
+		CacheTTL:         AGGREGATOR_CACHE_TTL,
+		cache:            make(map[string]aggregatorCacheEntry),
+	}
+}
+
+// Returns whether a call may go through right now
+func (a *ResilientAggregator) allow() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.failures < a.BreakerThreshold {
+		return true
+	}
+	if time.Now().Before(a.openUntil) || a.probing {
+		return false
+	}
+	// half-open: let exactly one call through to see if it's back
+	a.probing = true
+	return true
+}
+
+// Records the result of a call that `allow` let through
+func (a *ResilientAggregator) record(ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.probing = false
+	if ok {
+		if a.failures >= a.BreakerThreshold {
+			log.Println("aggregator: circuit breaker closed")
+		}
+		a.failures = 0
+		return
+	}
+	a.failures++
+	if a.failures >= a.BreakerThreshold {
+		if a.failures == a.BreakerThreshold {
+			log.Println("aggregator: circuit breaker opened")
+		}
+		a.openUntil = time.Now().Add(a.BreakerCooldown)
+	}
+}
+
+// Releases a call that `allow` let through without recording a result
+func (a *ResilientAggregator) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.probing = false
+}
+
+func (a *ResilientAggregator) cacheGet(key string) (any, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entry, ok := a.cache[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (a *ResilientAggregator) cachePut(key string, value any) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.cache) >= AGGREGATOR_CACHE_PRUNE_SIZE {
+		for k, entry := range a.cache {
+			if now.After(entry.expiresAt) {
+				delete(a.cache, k)
+			}
+		}
+	}
+	a.cache[key] = aggregatorCacheEntry{
+		value:     value,
+		expiresAt: now.Add(a.CacheTTL),
+	}
+}
+
+// Calls `f` through the cache, breaker and retry loop
+func resilientCall[T any](ctx context.Context, a *ResilientAggregator, key string, f func(ctx context.Context) (*T, error)) (*T, error) {
+	// (1) Serve from cache if we can
+	if value, ok := a.cacheGet(key); ok {
+		return value.(*T), nil
+	}
+
+	// (2) Fail fast if the breaker is open
+	if !a.allow() {
+		return nil, ErrAggregatorUnavailable
+	}
+
+	// (3) Try up to `Retries + 1` times, backing off exponentially
+	var err error
+	delay := a.RetryDelay
+	for attempt := 0; attempt <= a.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				a.release()
+				return nil, ctx.Err()
+			}
+			delay *= 2
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, a.AttemptTimeout)
+		var value *T
+		value, err = f(attemptCtx)
+		cancel()
+		if err == nil {
+			a.record(true)
+			a.cachePut(key, value)
+			return value, nil
+		}
+		var aggErr *AggregatorError
+		if errors.As(err, &aggErr) {
+			// the aggregator is up, it just didn't like the request
+			a.record(true)
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, which says nothing about the aggregator
+			a.release()
+			return nil, ctx.Err()
+		}
+	}
+
+	// (4) Out of retries
+	a.record(false)
+	return nil, fmt.Errorf("%w: %v", ErrAggregatorUnavailable, err)
+}
+
+func (a *ResilientAggregator) Deposit(ctx context.Context, game [32]byte, id [32]byte) (*DepositInfo, error) {
+	key := "deposit:" + base58.Encode(game[:]) + ":" + base58.Encode(id[:])
+	return resilientCall(ctx, a, key, func(ctx context.Context) (*DepositInfo, error) {
+		return a.Inner.Deposit(ctx, game, id)
+	})
+}
+
+func (a *ResilientAggregator) Withdrawal(ctx context.Context, game [32]byte, id [32]byte) (*WithdrawInfo, error) {
+	key := "withdrawal:" + base58.Encode(game[:]) + ":" + base58.Encode(id[:])
+	return resilientCall(ctx, a, key, func(ctx context.Context) (*WithdrawInfo, error) {
+		return a.Inner.Withdrawal(ctx, game, id)
+	})
+}
+
+// Health bypasses the cache and breaker, so it always reflects the
+// aggregator's actual state
+func (a *ResilientAggregator) Health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, a.AttemptTimeout)
+	defer cancel()
+	return a.Inner.Health(ctx)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Headers carrying a signed auth message, for REST requests that don't use
+// `Authorization: Bearer <session token or API key>`
+const REST_MESSAGE_HEADER = "X-Auth-Message"
+const REST_SIGNATURE_HEADER = "X-Auth-Signature"
+
+// A REST route, which calls the same handler as `Action` but takes
+// its parameters from different places: auth from headers, IDs from
+// the path, and everything else from the query string or JSON body.
+type RestRoute struct {
+	Method      string
+	Path        string
+	OperationId string
+	Status      int
+	Action      string
+	Body        bool              // whether parameters may be sent as a JSON body
+	Query       []string          // parameters read from the query string
+	PathParams  map[string]string // path wildcard -> the parameter it sets
+}
+
+var REST_ROUTES = []RestRoute{
+	{Method: "GET", Path: "/v1/me", OperationId: "getMe", Status: 200, Action: "user_get"},
+	{Method: "POST", Path: "/v1/bets", OperationId: "createBet", Status: 201, Action: "bet", Body: true},
+	{Method: "GET", Path: "/v1/bets", OperationId: "listBets", Status: 200, Action: "bet_page", Query: []string{"cursor", "count"}},
+	{Method: "POST", Path: "/v1/deposits", OperationId: "createDeposit", Status: 201, Action: "deposit", Body: true},
+	{Method: "GET", Path: "/v1/deposits/{id}", OperationId: "getDeposit", Status: 200, Action: "deposit_status", PathParams: map[string]string{"id": "depositId"}},
+}
+
+// The fields of `AuthData`, which REST routes read from headers instead
+var AUTH_FIELDS = []string{"message", "signature", "token", "apiKey"}
+
+// Registers `REST_ROUTES` on `mux`
+func RegisterRestRoutes(mux *http.ServeMux) {
+	for _, route := range REST_ROUTES {
+		a := FindAction(route.Action)
+		if a == nil {
+			panic("REST route " + route.Path + " calls unknown action " + route.Action)
+		}
+		mux.HandleFunc(route.Method+" "+route.Path, restHandler(route, a))
+	}
+
+	mux.HandleFunc("OPTIONS /v1/", func(w http.ResponseWriter, r *http.Request) {
+		restHeaders(w)
+	})
+
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		restHeaders(w)
+		writeError(w, NewError(CODE_NOT_FOUND, "not found"))
+	})
+}
+
+// The schema of the route's JSON body: the action's parameters,
+// minus those that come from somewhere else
+func (route RestRoute) BodySchema(a *Action) *Schema {
+	s := a.ParamsSchema.Clone()
+	s.name = ""
+	for name := range s.Properties {
+		if slices.Contains(AUTH_FIELDS, name) || slices.Contains(route.Query, name) {
+			delete(s.Properties, name)
+		}
+	}
+	for _, name := range route.PathParams {
+		delete(s.Properties, name)
+	}
+	s.Required = slices.DeleteFunc(s.Required, func(name string) bool {
+		_, ok := s.Properties[name]
+		return !ok
+	})
+	return s
+}
+
+func restHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+REST_MESSAGE_HEADER+", "+REST_SIGNATURE_HEADER)
+}
+
+// Handles a REST route by collecting its parameters, then calling its action.
+// The result is written as JSON with the route's status, or the error with
+// the status of its code.
+func restHandler(route RestRoute, a *Action) http.HandlerFunc {
+	body := route.BodySchema(a)
+	return func(w http.ResponseWriter, r *http.Request) {
+		restHeaders(w)
+		// responses depend on who's asking, so mustn't be shared between users
+		w.Header().Set("Cache-Control", "private")
+		w.Header().Set("Vary", "Authorization, "+REST_MESSAGE_HEADER+", "+REST_SIGNATURE_HEADER)
+
+		data, err := onRestRequest(r, route, a, body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, route.Status, data)
+	}
+}
+
+func onRestRequest(r *http.Request, route RestRoute, a *Action, bodySchema *Schema) (any, error) {
+	// (1) Body
+	params := map[string]any{}
+	if route.Body {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, NewError(CODE_INVALID_REQUEST, "can't read body")
+		}
+		request, err := DecodeRequest(body)
+		if err != nil {
+			return nil, err
+		}
+		err = bodySchema.Validate(request)
+		if err != nil {
+			return nil, err
+		}
+		// unknown fields are ignored, so they mustn't stand in
+		// for the auth headers, query string or path
+		for name, value := range request.(map[string]any) {
+			if _, ok := bodySchema.Properties[name]; ok {
+				params[name] = value
+			}
+		}
+	}
+
+	// (2) Query string + path
+	for _, name := range route.Query {
+		value := r.URL.Query().Get(name)
+		if value == "" {
+			continue
+		}
+		switch a.ParamsSchema.Properties[name].Type {
+		case "integer", "number":
+			params[name] = json.Number(value)
+		case "boolean":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, Errorf(CODE_INVALID_REQUEST, "invalid request: %s must be a boolean", name)
+			}
+			params[name] = b
+		default:
+			params[name] = value
+		}
+	}
+	for wildcard, name := range route.PathParams {
+		params[name] = r.PathValue(wildcard)
+	}
+
+	// (3) Auth
+	auth := restAuth(r)
+	for name, value := range map[string]string{
+		"message":   auth.Message,
+		"signature": auth.Signature,
+		"token":     auth.Token,
+		"apiKey":    auth.ApiKey,
+	} {
+		if value != "" {
+			params[name] = value
+		}
+	}
+
+	return a.Call(r.Context(), params, a.ParamsSchema)
+}
+
+// Reads the auth data of a REST request from its headers
+func restAuth(r *http.Request) AuthData {
+	var a AuthData
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if strings.HasPrefix(bearer, API_KEY_PREFIX) {
+			a.ApiKey = bearer
+		} else {
+			a.Token = bearer
+		}
+	}
+	a.Message = r.Header.Get(REST_MESSAGE_HEADER)
+	a.Signature = r.Header.Get(REST_SIGNATURE_HEADER)
+	return a
+}
+
+func writeJSON(w http.ResponseWriter, status int, data any) {
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// Writes `err` as an `ErrorResponse`, with the HTTP status of its code
+func writeError(w http.ResponseWriter, err error) {
+	e := ToUserError(err)
+	text, errMarshal := json.Marshal(ErrorResponse{
+		Error:   e.Message,
+		Code:    e.Code,
+		Details: e.Details,
+	})
+	if errMarshal != nil {
+		text = []byte(`{"error":"can't serialize error response"}`)
+	}
+	// unlike http.Error, keep the JSON content type
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status())
+	w.Write(append(text, '\n'))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A JSON schema, in the dialect of OpenAPI 3.0
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"` // false, or a *Schema
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Discriminator        map[string]any     `json:"discriminator,omitempty"`
+
+	name    string         // the Go type this describes, if it has a name
+	pattern *regexp.Regexp // `Pattern`, compiled
+}
+
+// Returns the schema of Go type `t`, as encoding/json would encode it.
+//
+// Structs describing parameters (`result` = false) don't allow unknown
+// fields, though `Validate` ignores them, so that old clients sending fields
+// we've since removed keep working. Their fields are optional unless tagged
+// `schema:"required"`. Other constraints can be added to the same tag:
+// `minimum=`, `maximum=`, `minLength=`, `maxLength=`, `pattern=` and
+// `enum=a|b`, which apply to the items of slices, plus `minItems=` and
+// `maxItems=` for slices.
+// Fields of result structs are always present unless they're `omitempty`.
+func SchemaOf(t reflect.Type, result bool) *Schema {
+	if t == reflect.TypeFor[json.RawMessage]() {
+		// any JSON value
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := SchemaOf(t.Elem(), result)
+		if s.name != "" {
+			// a $ref can't have siblings, so wrap it
+			return &Schema{AllOf: []*Schema{s}, Nullable: true}
+		}
+		s.Nullable = true
+		return s
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s := &Schema{Type: "integer", Format: "int64"}
+		if t.Bits() < 64 {
+			s.Format = "int32"
+			s.Minimum = ptr(-math.Pow(2, float64(t.Bits()-1)))
+			s.Maximum = ptr(math.Pow(2, float64(t.Bits()-1)) - 1)
+		}
+		return s
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s := &Schema{Type: "integer", Format: "int64", Minimum: ptr(0.0)}
+		if t.Bits() < 64 {
+			s.Format = "int32"
+			s.Maximum = ptr(math.Pow(2, float64(t.Bits())) - 1)
+		}
+		return s
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: SchemaOf(t.Elem(), result)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: SchemaOf(t.Elem(), result)}
+	case reflect.Interface:
+		return &Schema{}
+	case reflect.Struct:
+		s := &Schema{
+			Type:       "object",
+			Properties: map[string]*Schema{},
+			name:       t.Name(),
+		}
+		if !result {
+			s.AdditionalProperties = false
+		}
+		addStructFields(s, t, result)
+		return s
+	}
+	panic("no schema for type " + t.String())
+}
+
+// Adds the fields of struct `t` to `s`, including those of embedded structs
+func addStructFields(s *Schema, t reflect.Type, result bool) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addStructFields(s, f.Type, result)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		field := SchemaOf(f.Type, result)
+		required := result && !slices.Contains(strings.Split(opts, ","), "omitempty")
+		if constraints := f.Tag.Get("schema"); constraints != "" {
+			required = applyConstraints(field, constraints, t.Name()+"."+f.Name) || required
+		}
+		s.Properties[name] = field
+		if required {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// Applies the constraints of a `schema` tag to `s`, returning whether
+// the field is required
+func applyConstraints(s *Schema, tag string, field string) bool {
+	required := false
+	for _, c := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(c, "=")
+		target := s
+		if s.Items != nil && (key == "enum" || key == "pattern") {
+			target = s.Items
+		}
+		var err error
+		switch key {
+		case "required":
+			required = true
+		case "minimum", "maximum":
+			var n float64
+			n, err = strconv.ParseFloat(value, 64)
+			if key == "minimum" {
+				target.Minimum = &n
+			} else {
+				target.Maximum = &n
+			}
+		case "minLength", "maxLength":
+			var n int
+			n, err = strconv.Atoi(value)
+			if key == "minLength" {
+				target.MinLength = &n
+			} else {
+				target.MaxLength = &n
+			}
+		case "minItems", "maxItems":
+			var n int
+			n, err = strconv.Atoi(value)
+			if key == "minItems" {
+				target.MinItems = &n
+			} else {
+				target.MaxItems = &n
+			}
+		case "pattern":
+			target.Pattern = value
+			target.pattern, err = regexp.Compile(value)
+		case "enum":
+			for _, v := range strings.Split(value, "|") {
+				target.Enum = append(target.Enum, v)
+			}
+		default:
+			err = fmt.Errorf("unknown constraint %q", key)
+		}
+		if err != nil {
+			panic(fmt.Sprintf("invalid schema tag on %s: %v", field, err))
+		}
+	}
+	return required
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// Returns a copy of `s` whose properties and required fields
+// can be changed without affecting `s`
+func (s *Schema) Clone() *Schema {
+	c := *s
+	c.Properties = maps.Clone(s.Properties)
+	c.Required = slices.Clone(s.Required)
+	return &c
+}
+
+// Checks that `v`, as decoded by `DecodeRequest`, matches the schema
+func (s *Schema) Validate(v any) error {
+	err := s.validate("", v)
+	if err != nil {
+		// don't return a nil *Error as a non-nil error
+		return err
+	}
+	return nil
+}
+
+func (s *Schema) validate(path string, v any) *Error {
+	fail := func(format string, args ...any) *Error {
+		if path == "" {
+			return Errorf(CODE_INVALID_REQUEST, "invalid request: request %s", fmt.Sprintf(format, args...))
+		}
+		e := Errorf(CODE_INVALID_REQUEST, "invalid request: %s %s", path, fmt.Sprintf(format, args...))
+		e.Details = map[string]any{"field": path}
+		return e
+	}
+
+	if v == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return fail("must not be null")
+	}
+	for _, sub := range s.AllOf {
+		if err := sub.validate(path, v); err != nil {
+			return err
+		}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fail("must be an object")
+		}
+		fieldPath := func(name string) string {
+			if path == "" {
+				return name
+			}
+			return path + "." + name
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				e := Errorf(CODE_INVALID_REQUEST, "invalid request: %s is required", fieldPath(name))
+				e.Details = map[string]any{"field": fieldPath(name)}
+				return e
+			}
+		}
+		// check fields in a stable order, so errors are reproducible
+		for _, name := range slices.Sorted(maps.Keys(obj)) {
+			prop := s.Properties[name]
+			if prop == nil {
+				switch additional := s.AdditionalProperties.(type) {
+				case bool:
+					// ignored even when they aren't allowed, see `SchemaOf`
+					continue
+				case *Schema:
+					prop = additional
+				default:
+					continue
+				}
+			}
+			if err := prop.validate(fieldPath(name), obj[name]); err != nil {
+				return err
+			}
+		}
+
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fail("must be an array")
+		}
+		if s.MinItems != nil && len(arr) < *s.MinItems {
+			return fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(arr) > *s.MaxItems {
+			return fail("must have at most %d items", *s.MaxItems)
+		}
+		for i, item := range arr {
+			if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item); err != nil {
+				return err
+			}
+		}
+
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		n := utf8.RuneCountInString(str)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fail("must match %s", s.Pattern)
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, any(str)) {
+			return fail("must be one of %v", s.Enum)
+		}
+
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			return fail("must be a number")
+		}
+		var n float64
+		if s.Type == "integer" {
+			// parse exactly, since a float64 can't hold every uint64
+			if i, err := strconv.ParseInt(string(num), 10, 64); err == nil {
+				n = float64(i)
+			} else if u, err := strconv.ParseUint(string(num), 10, 64); err == nil {
+				n = float64(u)
+			} else {
+				return fail("must be an integer")
+			}
+		} else {
+			f, err := num.Float64()
+			if err != nil {
+				return fail("must be a number")
+			}
+			n = f
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fail("must be at most %v", *s.Maximum)
+		}
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("must be a boolean")
+		}
+	}
+	return nil
+}
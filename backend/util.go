@@ -5,11 +5,8 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"net/http"
 	"regexp"
 	"strconv"
 	"time"
@@ -64,68 +61,84 @@ var VERIFY_MESSAGE_REGEX = regexp.MustCompile(
 	`^Authenticate user ([1-9A-Za-z]+) to game ([1-9A-Za-z]+) on ivypowered\.com, valid from ([0-9]+) to ([0-9]+)$`,
 )
 
-// Verify an authentication message and return the authenticated user, or an error
-// if the message is invalid.
-func VerifyMessage(game [32]byte, message string, signature string) ([32]byte, error) {
+// A verified authentication message
+type AuthMessage struct {
+	User [32]byte
+	From uint64
+	To   uint64
+}
+
+// Verify an authentication message and return its contents, or an error
+// if the message is invalid. Messages must be valid for at most
+// `AUTH_MESSAGE_MAX_VALIDITY`, and `from`/`to` are checked with
+// `AUTH_CLOCK_SKEW` of tolerance either way.
+func VerifyAuthMessage(game [32]byte, message string, signature string) (AuthMessage, error) {
 	matches := VERIFY_MESSAGE_REGEX.FindAllStringSubmatch(message, -1)
 	if len(matches) == 0 || len(matches[0]) < 5 {
-		return [32]byte{}, errors.New("invalid auth message format")
+		return AuthMessage{}, NewError(CODE_AUTH_INVALID, "invalid auth message format")
 	}
 	userBytes, err := base58.Decode(matches[0][1])
 	if err != nil {
-		return [32]byte{}, fmt.Errorf("invalid user format in auth message: %v", err)
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "invalid user format in auth message: %v", err)
 	}
 	if len(userBytes) != ed25519.PublicKeySize {
-		return [32]byte{}, errors.New("user public key is too large in auth message")
+		return AuthMessage{}, NewError(CODE_AUTH_INVALID, "user public key is too large in auth message")
 	}
 	user := ed25519.PublicKey(userBytes)
 	gameBytes, err := base58.Decode(matches[0][2])
 	if err != nil {
-		return [32]byte{}, fmt.Errorf("invalid game format in auth message: %v", err)
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "invalid game format in auth message: %v", err)
 	}
 	if len(gameBytes) != ed25519.PublicKeySize {
-		return [32]byte{}, errors.New("game public key is too large in auth message")
+		return AuthMessage{}, NewError(CODE_AUTH_INVALID, "game public key is too large in auth message")
 	}
 	gameProvided := ed25519.PublicKey(gameBytes)
 	if !gameProvided.Equal(ed25519.PublicKey(game[:])) {
-		return [32]byte{}, fmt.Errorf("invalid game in auth message (provided %s, expected %s)", base58.Encode(gameProvided), base58.Encode(game[:]))
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "invalid game in auth message (provided %s, expected %s)", base58.Encode(gameProvided), base58.Encode(game[:]))
 	}
 	from, err := strconv.ParseUint(matches[0][3], 10, 0)
 	if err != nil {
-		return [32]byte{}, fmt.Errorf("invalid from format in auth message: %v", err)
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "invalid from format in auth message: %v", err)
 	}
 	to, err := strconv.ParseUint(matches[0][4], 10, 0)
 	if err != nil {
-		return [32]byte{}, fmt.Errorf("invalid to format in auth message: %v", err)
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "invalid to format in auth message: %v", err)
+	}
+	if to < from {
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "auth message ends before it starts: valid from %d to %d", from, to)
+	}
+	if to-from > uint64(AUTH_MESSAGE_MAX_VALIDITY.Seconds()) {
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "auth message validity too long: valid from %d to %d, but may be valid for at most %s", from, to, AUTH_MESSAGE_MAX_VALIDITY)
 	}
 	now := uint64(time.Now().Unix())
-	if now < from || now > to {
-		return [32]byte{}, fmt.Errorf("expiry of auth message: only valid from %d to %d, but time is %d", from, to, now)
+	skew := uint64(AUTH_CLOCK_SKEW.Seconds())
+	if now+skew < from || now > to+skew {
+		code := CODE_AUTH_EXPIRED
+		if now+skew < from {
+			code = CODE_AUTH_INVALID // not valid yet
+		}
+		e := Errorf(code, "expiry of auth message: only valid from %d to %d, but time is %d", from, to, now)
+		e.Details = map[string]any{"from": from, "to": to, "now": now}
+		return AuthMessage{}, e
 	}
 	sig := make([]byte, 64)
 	n, err := hex.Decode(sig, []byte(signature))
 	if err != nil {
-		return [32]byte{}, fmt.Errorf("invalid signature in auth message: %v", err)
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "invalid signature in auth message: %v", err)
 	}
 	if n != 64 {
-		return [32]byte{}, fmt.Errorf("signature invalid length in auth message: expected 64, got %d", n)
+		return AuthMessage{}, Errorf(CODE_AUTH_INVALID, "signature invalid length in auth message: expected 64, got %d", n)
 	}
 	valid := ed25519.Verify(user, []byte(message), sig)
 	if !valid {
-		return [32]byte{}, errors.New("invalid auth message signature")
+		return AuthMessage{}, NewError(CODE_AUTH_INVALID, "invalid auth message signature")
 	}
-	u := [32]byte{}
-	copy(u[:], user[:])
-	return u, nil
-}
-
-// Just like VerifyMessage, but returns the user as a base58-encoded string.
-func VerifyMessageB58(game [32]byte, message string, signature string) (string, error) {
-	bytes, err := VerifyMessage(game, message, signature)
-	if err != nil {
-		return "", err
+	am := AuthMessage{
+		From: from,
+		To:   to,
 	}
-	return base58.Encode(bytes[:]), nil
+	copy(am.User[:], user[:])
+	return am, nil
 }
 
 // Convert cents to raw
@@ -159,42 +172,3 @@ func DecodeHex32(s string) ([32]byte, error) {
 	copy(b[:], bytes[:])
 	return b, nil
 }
-
-type DepositInfo struct {
-	Signature string `json:"signature"`
-	Timestamp uint64 `json:"timestamp"`
-}
-
-type DepositSuccess struct {
-	Status string       `json:"status"`
-	Data   *DepositInfo `json:"data"`
-}
-
-type DepositError struct {
-	Status string `json:"status"`
-	Msg    string `json:"msg"`
-}
-
-// Fetches the deposit info. `*DepositInfo` will be nil on success if no deposit exists
-func FetchDepositInfo(aggregator_url string, game [32]byte, id [32]byte) (*DepositInfo, error) {
-	url := AGGREGATOR_URL + "/games/" + base58.Encode(game[:]) + "/deposits/" + hex.EncodeToString(id[:])
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	bytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	var de DepositError
-	err = json.Unmarshal(bytes, &de)
-	if err == nil && de.Status == "err" {
-		return nil, errors.New(de.Msg)
-	}
-	var ds DepositSuccess
-	err = json.Unmarshal(bytes, &ds)
-	if err != nil {
-		return nil, err
-	}
-	return ds.Data, nil
-}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/mr-tron/base58"
+)
+
+// The header carrying the hex-encoded ed25519 signature of the webhook body
+const WEBHOOK_SIGNATURE_HEADER = "X-Aggregator-Signature"
+
+// The largest webhook body we'll read
+const WEBHOOK_MAX_BODY_SIZE = 64 * 1024
+
+var ErrInvalidWebhookSignature = NewError(CODE_AUTH_INVALID, "invalid webhook signature")
+
+// Sent by the aggregator (or a local relay) when a deposit lands on-chain
+type DepositWebhook struct {
+	Game      string `json:"game"`      // base58
+	DepositId string `json:"depositId"` // hex
+	Signature string `json:"signature"` // the deposit transaction
+	Timestamp uint64 `json:"timestamp"`
+}
+
+// Verify that `body` was signed by `key`, given the hex-encoded `signature`
+func VerifyWebhookSignature(key [32]byte, body []byte, signature string) error {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrInvalidWebhookSignature
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key[:]), body, sig) {
+		return ErrInvalidWebhookSignature
+	}
+	return nil
+}
+
+// Completes the deposit described by a signed webhook. Replays are harmless,
+// since completing a deposit twice only credits the user once.
+func onDepositWebhook(key [32]byte, body []byte, signature string) (Deposit, error) {
+	// (1) Check the aggregator signed this
+	err := VerifyWebhookSignature(key, body, signature)
+	if err != nil {
+		return Deposit{}, err
+	}
+
+	// (2) Parse + check it's for our game
+	var p DepositWebhook
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		return Deposit{}, err
+	}
+	if p.Game != base58.Encode(GAME_ADDRESS[:]) {
+		return Deposit{}, NewError(CODE_INVALID_REQUEST, "webhook is for a different game")
+	}
+	if p.Signature == "" {
+		return Deposit{}, NewError(CODE_INVALID_REQUEST, "webhook is missing the deposit signature")
+	}
+
+	// (3) Complete the deposit
+	deposit, err := DB.DepositGet(p.DepositId)
+	if err == sql.ErrNoRows {
+		return Deposit{}, NewError(CODE_NOT_FOUND, "deposit not found")
+	}
+	if err != nil {
+		return Deposit{}, err
+	}
+	return completeDeposit(deposit, DepositInfo{
+		Signature: p.Signature,
+		Timestamp: p.Timestamp,
+	})
+}
+
+// Returns an HTTP handler for deposit webhooks signed by `key`
+func DepositWebhookHandler(key [32]byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != "POST" {
+			writeError(w, NewError(CODE_METHOD_NOT_ALLOWED, "method not allowed"))
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, WEBHOOK_MAX_BODY_SIZE))
+		if err != nil {
+			writeError(w, NewError(CODE_INVALID_REQUEST, "can't read body"))
+			return
+		}
+		deposit, err := onDepositWebhook(key, body, r.Header.Get(WEBHOOK_SIGNATURE_HEADER))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, 200, deposit)
+	}
+}
@@ -1,7 +1,11 @@
 <?php
 require_once __DIR__ . "/util.php";
 
-$user = authenticate();
+try {
+    $user = authenticate();
+} catch (Exception $e) {
+    unavailable($e);
+}
 if (!$user["logged_in"]) {
     header("Location: /");
     exit();
@@ -20,8 +24,7 @@ if ($_SERVER["REQUEST_METHOD"] === "POST") {
             try {
                 $result = call_backend([
                     "action" => "deposit",
-                    "message" => $user["message"],
-                    "signature" => $user["signature"],
+                    "token" => $user["token"],
                     "amountCents" => intval($amount * 100),
                 ]);
                 $success_message = "Deposit created successfully!";
@@ -38,8 +41,7 @@ if ($_SERVER["REQUEST_METHOD"] === "POST") {
             try {
                 $updated_deposit = call_backend([
                     "action" => "deposit_status",
-                    "message" => $user["message"],
-                    "signature" => $user["signature"],
+                    "token" => $user["token"],
                     "depositId" => $deposit_id,
                 ]);
                 if ($updated_deposit["completed"]) {
@@ -49,6 +51,11 @@ if ($_SERVER["REQUEST_METHOD"] === "POST") {
                         "... has been completed!";
                     // Update user
                     $user = authenticate();
+                } elseif (!empty($updated_deposit["confirmationDelayed"])) {
+                    $error_message =
+                        "Deposit " .
+                        substr($deposit_id, 0, 8) .
+                        "... is pending, but confirmation is delayed. If you've paid, your balance will update once we can confirm it.";
                 } else {
                     $error_message =
                         "Deposit " .
@@ -62,14 +69,29 @@ if ($_SERVER["REQUEST_METHOD"] === "POST") {
     }
 }
 
+// Redirected here by the deposit event stream (see below)
+if (
+    isset($_GET["completed"]) &&
+    is_string($_GET["completed"]) &&
+    preg_match('/^[0-9a-f]{64}$/', $_GET["completed"])
+) {
+    $success_message =
+        "Deposit " . substr($_GET["completed"], 0, 8) . "... has been completed!";
+}
+
 // Fetch recent deposits
 $recent_deposits = call_backend([
     "action" => "deposit_list",
-    "message" => $user["message"],
-    "signature" => $user["signature"],
+    "token" => $user["token"],
     "count" => 10,
     "skip" => 0,
 ]);
+$pending_deposit_ids = [];
+foreach ($recent_deposits as $deposit) {
+    if (!$deposit["completed"] && !$deposit["expired"]) {
+        $pending_deposit_ids[] = $deposit["id"];
+    }
+}
 ?>
 
 <!doctype html>
@@ -129,7 +151,7 @@ $recent_deposits = call_backend([
                             ) ?>" target="_blank" class="text-blue-400 hover:text-blue-300 underline">
                                 Click here to complete your deposit
                             </a>
-                            <p>Afterwards, press "Check" below!</p>
+                            <p>This page will update as soon as it's paid.</p>
                         <?php endif; ?>
                     </div>
                 <?php endif; ?>
@@ -224,6 +246,10 @@ $recent_deposits = call_backend([
                                                     $deposit["completed"]
                                                 ): ?>
                                                     <span class="text-green-400">Completed</span>
+                                                <?php elseif (
+                                                    $deposit["expired"]
+                                                ): ?>
+                                                    <span class="text-gray-400">Expired</span>
                                                 <?php else: ?>
                                                     <span class="text-yellow-400">Pending</span>
                                                 <?php endif; ?>
@@ -267,5 +293,35 @@ $recent_deposits = call_backend([
                 </div>
             </div>
         </main>
+
+        <script id="pending-deposits" type="application/json"><?= json_encode(
+            $pending_deposit_ids
+        ) ?></script>
+        <script>
+            // Wait for pending deposits to complete, newest first. Each one
+            // holds a connection open, and browsers only allow a few per site.
+            const MAX_DEPOSIT_STREAMS = 3;
+            const pending = JSON.parse(
+                document.getElementById("pending-deposits").textContent,
+            );
+            for (const id of pending.slice(0, MAX_DEPOSIT_STREAMS)) {
+                const source = new EventSource(
+                    "deposit_events.php?id=" + encodeURIComponent(id),
+                );
+                source.addEventListener("deposit", (event) => {
+                    const deposit = JSON.parse(event.data);
+                    if (deposit.completed) {
+                        source.close();
+                        window.location.href =
+                            "deposit.php?completed=" +
+                            encodeURIComponent(deposit.id);
+                    } else if (deposit.expired) {
+                        // show it as expired
+                        source.close();
+                        window.location.href = "deposit.php";
+                    }
+                });
+            }
+        </script>
     </body>
 </html>
@@ -0,0 +1,57 @@
+<?php
+// Relays the backend's Server-Sent Events stream for a deposit to the
+// browser, so `deposit.php` can find out when it completes without polling.
+require_once __DIR__ . "/util.php";
+
+try {
+    $user = authenticate();
+} catch (Exception $e) {
+    unavailable($e);
+}
+if (!$user["logged_in"]) {
+    http_response_code(401);
+    exit();
+}
+
+$deposit_id = $_GET["id"] ?? "";
+if (!is_string($deposit_id) || !preg_match('/^[0-9a-f]{64}$/', $deposit_id)) {
+    http_response_code(400);
+    exit();
+}
+
+// The backend ends the stream once the deposit completes or expires, or
+// after 10 minutes, and the browser then reconnects. Time out a little
+// later here, so a stuck backend can't hold on to this worker forever.
+const DEPOSIT_EVENTS_TIMEOUT = 11 * 60;
+set_time_limit(DEPOSIT_EVENTS_TIMEOUT);
+while (ob_get_level() > 0) {
+    ob_end_flush();
+}
+
+$started = false;
+$ch = curl_init();
+curl_setopt_array($ch, [
+    CURLOPT_URL => BACKEND_URL . "/v1/deposits/" . $deposit_id . "/events",
+    CURLOPT_HTTPHEADER => ["Authorization: Bearer " . $user["token"]],
+    CURLOPT_CONNECTTIMEOUT => 5,
+    CURLOPT_TIMEOUT => DEPOSIT_EVENTS_TIMEOUT,
+    CURLOPT_WRITEFUNCTION => function ($ch, $data) use (&$started) {
+        if (!$started) {
+            // Pass errors on as-is, so the browser doesn't keep reconnecting
+            $status = curl_getinfo($ch, CURLINFO_HTTP_CODE);
+            if ($status !== 200) {
+                http_response_code($status);
+                return 0;
+            }
+            header("Content-Type: text/event-stream");
+            header("Cache-Control: no-cache");
+            header("X-Accel-Buffering: no");
+            $started = true;
+        }
+        echo $data;
+        flush();
+        return connection_aborted() ? 0 : strlen($data);
+    },
+]);
+curl_exec($ch);
+curl_close($ch);
@@ -1,8 +1,11 @@
-const HOUSE_EDGE = 0.01; // 1%
-const UNDER_MIN = 1.0;
-const UNDER_MAX = 98.02;
-const OVER_MIN = 1.97;
-const OVER_MAX = 98.99;
+const GAME_PARAMS = JSON.parse(
+    document.getElementById("game-params").textContent,
+);
+const HOUSE_EDGE = GAME_PARAMS.houseEdgePct / 100;
+const UNDER_MIN = GAME_PARAMS.underMin / 100;
+const UNDER_MAX = GAME_PARAMS.underMax / 100;
+const OVER_MIN = GAME_PARAMS.overMin / 100;
+const OVER_MAX = GAME_PARAMS.overMax / 100;
 
 function getId(id) {
     const element = document.getElementById(id);
@@ -215,7 +218,12 @@ if (parentOrigin && loginBtn) {
             };
             return;
         }
-        if (!d.signature || !d.message) {
+        // don't sign in again with a message the backend just rejected
+        if (
+            !d.signature ||
+            !d.message ||
+            d.message === loginBtn.dataset.rejectedMessage
+        ) {
             loginBtn.classList.remove("disabled");
             loginBtn.innerText = "Sign In";
             loginBtn.onclick = function () {
@@ -249,30 +257,5 @@ if (logoutBtn) {
     };
 }
 
-// Get client seed
-/** @type HTMLInputElement */
-const clientSeed = getId("client-seed");
-const csBytes = new Uint8Array(16);
-crypto.getRandomValues(csBytes);
-let csHex = "";
-for (let i = 0; i < csBytes.length; i++) {
-    const b = csBytes[i];
-    const p = [b & 0xf, b >> 4];
-    for (const v of p) {
-        if (v >= 0 && v <= 9) {
-            csHex += String.fromCharCode(
-                48 + // '0'
-                    v,
-            );
-        } else if (v >= 0xa && v <= 0xf) {
-            csHex += String.fromCharCode(
-                97 + // 'a'
-                    (v - 0xa),
-            );
-        }
-    }
-}
-clientSeed.value = csHex;
-
 // Initial render
 render("");
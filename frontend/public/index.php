@@ -1,25 +1,27 @@
 <?php
 require_once __DIR__ . "/util.php";
 
-$user = authenticate();
-$max_bet =
-    call_backend([
-        "action" => "max_bet",
-    ])["maxBetCents"] / 100.0;
+try {
+    $user = authenticate();
+    $game_params = call_backend([
+        "action" => "game_params",
+    ]);
+} catch (Exception $e) {
+    unavailable($e);
+}
+$max_bet = $game_params["maxBetCents"] / 100.0;
 
 // Handle bet submission
 $bet_result = null;
 $bet_error = null;
-if (isset($_POST["client_seed"]) && $user["logged_in"]) {
+if (($_POST["action"] ?? "") === "bet" && $user["logged_in"]) {
     try {
         $bet_result = call_backend([
             "action" => "bet",
-            "message" => $user["message"],
-            "signature" => $user["signature"],
+            "token" => $user["token"],
             "wagerCents" => (int) (floatval($_POST["bet_amount"]) * 100),
             "rollUnder" => $_POST["is_under"] === "true" ? true : false,
             "threshold" => (int) (floatval($_POST["threshold"]) * 100),
-            "clientSeed" => $_POST["client_seed"],
         ]);
 
         // Update user balance after bet
@@ -31,13 +33,32 @@ if (isset($_POST["client_seed"]) && $user["logged_in"]) {
     }
 }
 
+// Handle seed rotation, which reveals the current server seed
+$rotation = null;
+$rotation_error = null;
+if (($_POST["action"] ?? "") === "rotate_seed" && $user["logged_in"]) {
+    $client_seed = trim(
+        is_string($_POST["client_seed"] ?? null) ? $_POST["client_seed"] : "",
+    );
+    try {
+        $rotation = call_backend([
+            "action" => "rotate_seed",
+            "token" => $user["token"],
+            "clientSeed" => $client_seed,
+        ]);
+        $user["serverSeedHash"] = $rotation["nextServerSeedHash"];
+        $user["clientSeed"] = $rotation["nextClientSeed"];
+    } catch (Exception $e) {
+        $rotation_error = $e->getMessage();
+    }
+}
+
 $recent_bets = [];
 if ($user["logged_in"]) {
     try {
         $recent_bets = call_backend([
             "action" => "bet_list",
-            "message" => $user["message"],
-            "signature" => $user["signature"],
+            "token" => $user["token"],
             "count" => 10,
             "skip" => 0,
         ]);
@@ -216,6 +237,9 @@ if ($user["logged_in"]) {
                     <?php else: ?>
                         <button
                             id="login-btn"
+                            data-rejected-message="<?= htmlspecialchars(
+                                $user["rejected_message"],
+                            ) ?>"
                             class="px-4 py-2 bg-gray-600 text-gray-300 rounded-md hover:bg-gray-500 transition-colors mr-8 disabled"
                         >Return to Ivy to log in</button>
                     <?php endif; ?>
@@ -297,7 +321,7 @@ if ($user["logged_in"]) {
                             "parentOrigin"
                         ] ?? "" ?>" />
                     <? } ?>
-                    <input type="hidden" id="client-seed" name="client_seed" value="" />
+                    <input type="hidden" name="action" value="bet" />
                     <input type="hidden" id="is-under" name="is_under" value="<?= isset(
                         $_POST["is_under"]
                     )
@@ -455,17 +479,87 @@ if ($user["logged_in"]) {
                                 </span>
                             </div>
                         </div>
-                        <?php if (isset($bet_result["serverSeed"])): ?>
+                        <?php if (isset($bet_result["serverSeedHash"])): ?>
                         <div style="margin-top: 15px; font-size: 0.8rem; opacity: 0.7;">
-                            Server Seed: <?= htmlspecialchars(
-                                $bet_result["serverSeed"]
+                            Server Seed Hash: <?= htmlspecialchars(
+                                $bet_result["serverSeedHash"]
                             ) ?>
+                            <br>
+                            Client Seed: <?= htmlspecialchars(
+                                $bet_result["clientSeed"]
+                            ) ?>, Nonce: <?= (int) $bet_result["nonce"] ?>
                         </div>
                         <?php endif; ?>
                     <?php endif; ?>
                 </div>
                 <?php endif; ?>
 
+                <!-- Provably Fair: reveal the current seeds and start new ones -->
+                <?php if ($user["logged_in"]): ?>
+                <form method="post" class="recent-bets-table">
+                    <h3 class="text-lg font-bold mb-4">Provably Fair</h3>
+                    <p class="text-sm text-gray-400 mb-4">
+                        Your bets are rolled from a server seed, committed to by
+                        its hash below, and your client seed. Rotate them to
+                        reveal the server seed, so you can verify your bets.
+                    </p>
+                    <div class="text-sm mb-4" style="word-break: break-all;">
+                        Server Seed Hash: <?= htmlspecialchars(
+                            $user["serverSeedHash"]
+                        ) ?>
+                        <br>
+                        Client Seed: <?= htmlspecialchars($user["clientSeed"]) ?>
+                    </div>
+                    <? if (isset($_GET["parentOrigin"])) { ?>
+                        <input type="hidden" name="parentOrigin" value="<?= $_GET[
+                            "parentOrigin"
+                        ] ?? "" ?>" />
+                    <? } ?>
+                    <input type="hidden" name="action" value="rotate_seed" />
+                    <div class="flex gap-4">
+                        <input
+                            type="text"
+                            name="client_seed"
+                            placeholder="New client seed (optional)"
+                            minlength="<?= (int) $game_params[
+                                "clientSeedMinLength"
+                            ] ?>"
+                            maxlength="<?= (int) $game_params[
+                                "clientSeedMaxLength"
+                            ] ?>"
+                            class="flex-1 px-3 py-2 bg-gray-800 border border-gray-600 rounded-md"
+                        />
+                        <button
+                            type="submit"
+                            class="px-4 py-2 border-2 border-gray-500 text-gray-300 rounded-md hover:bg-gray-700 hover:text-white"
+                        >Rotate Seed</button>
+                    </div>
+                    <?php if ($rotation_error !== null): ?>
+                        <div class="bet-result error">
+                            <?= htmlspecialchars($rotation_error) ?>
+                        </div>
+                    <?php elseif ($rotation !== null): ?>
+                        <div class="text-sm mt-4" style="word-break: break-all;">
+                            Revealed Server Seed: <?= htmlspecialchars(
+                                $rotation["serverSeed"]
+                            ) ?>
+                            <br>
+                            Its Hash: <?= htmlspecialchars(
+                                $rotation["serverSeedHash"]
+                            ) ?>
+                            <br>
+                            Client Seed: <?= htmlspecialchars(
+                                $rotation["clientSeed"]
+                            ) ?>, Bets: <?= (int) $rotation["nonce"] ?>
+                            <br>
+                            Next Server Seed Hash: <?= htmlspecialchars(
+                                $rotation["nextServerSeedHash"]
+                            ) ?>
+                        </div>
+                    <?php endif; ?>
+                </form>
+                <?php endif; ?>
+
                 <!-- Recent Bets Table -->
                 <?php if ($user["logged_in"] && !empty($recent_bets)): ?>
                 <div class="recent-bets-table">
@@ -506,7 +600,7 @@ if ($user["logged_in"]) {
                                         $payout =
                                             ($bet["amountCents"] *
                                                 10000 *
-                                                (100 - 1)) /
+                                                (100 - $bet["houseEdgePct"])) /
                                             ($underAmount * 100);
                                         echo "+" .
                                             number_format(
@@ -533,9 +627,9 @@ if ($user["logged_in"]) {
         </main>
 
         <p id="max-bet" class="hidden"><?= $max_bet ?></p>
-        <p id="server-seed-hash" class="hidden"><?= $user[
-            "serverSeedHash"
-        ] ?></p>
+        <script id="game-params" type="application/json"><?= json_encode(
+            $game_params
+        ) ?></script>
 
         <script type="text/javascript" src="index.js"></script>
 
@@ -1,6 +1,34 @@
 <?php
 const BACKEND_URL = "http://127.0.0.1:8000";
 
+/**
+ * An error response from the backend
+ */
+class BackendException extends Exception
+{
+    /** @var string The error's code, e.g. `AUTH_EXPIRED` */
+    public $error_code;
+
+    public function __construct($message, $error_code)
+    {
+        parent::__construct($message);
+        $this->error_code = $error_code;
+    }
+
+    /**
+     * Whether the credentials used were rejected
+     * @return bool
+     */
+    public function is_auth_error()
+    {
+        return in_array(
+            $this->error_code,
+            ["AUTH_REQUIRED", "AUTH_INVALID", "AUTH_EXPIRED"],
+            true,
+        );
+    }
+}
+
 /**
  * Call the dice backend, throwing an exception if there was an error
  * either in the protocol or in the backend's response
@@ -50,7 +78,10 @@ function call_backend($data)
 
     // Check for `error`
     if (is_array($decoded) && isset($decoded["error"])) {
-        throw new Exception($decoded["error"]);
+        throw new BackendException(
+            $decoded["error"],
+            is_string($decoded["code"] ?? null) ? $decoded["code"] : "",
+        );
     }
 
     // Return response
@@ -88,8 +119,82 @@ function icon($icon, $class_name = "")
 }
 
 /**
- * Authenticate the user with the backend.
- * @return array The user object: { id: string; balance: number, logged_in: boolean, message: string, signature: string }
+ * Show an error page and stop, for when the backend can't be reached
+ * @param Exception $e The error
+ */
+function unavailable($e)
+{
+    error_log("backend unavailable: " . $e->getMessage());
+    http_response_code(503);
+    echo "Ivy Dice is unavailable right now. Please try again in a moment.";
+    exit();
+}
+
+/**
+ * Delete a cookie, for the rest of this request too
+ * @param string $name The cookie's name
+ */
+function clear_cookie($name)
+{
+    setcookie($name, "", [
+        "expires" => 1,
+        "path" => "/",
+        "secure" => true,
+        "httponly" => $name === "Token",
+        "samesite" => "Strict",
+    ]);
+    unset($_COOKIE[$name]);
+}
+
+/**
+ * Get a session token for the signed auth message, reusing the one in the
+ * `Token` cookie if it was issued for the same message and hasn't expired.
+ * The cookie holds `sha256(message):expiresAt:token`.
+ * @param bool $reuse False to log in again, e.g. if the backend rejected the
+ *   token in the cookie
+ * @return string The session token
+ */
+function session_token($message, $signature, $reuse = true)
+{
+    $message_hash = hash("sha256", $message);
+    $cookie =
+        isset($_COOKIE["Token"]) && is_string($_COOKIE["Token"])
+            ? explode(":", $_COOKIE["Token"], 3)
+            : [];
+    // refresh a minute early so the token doesn't expire mid-request
+    if (
+        $reuse &&
+        count($cookie) === 3 &&
+        hash_equals($message_hash, $cookie[0]) &&
+        intval($cookie[1]) > time() + 60
+    ) {
+        return $cookie[2];
+    }
+
+    $login = call_backend([
+        "action" => "login",
+        "message" => $message,
+        "signature" => $signature,
+    ]);
+    setcookie(
+        "Token",
+        $message_hash . ":" . $login["expiresAt"] . ":" . $login["token"],
+        [
+            "expires" => $login["expiresAt"],
+            "path" => "/",
+            "secure" => true,
+            "httponly" => true,
+            "samesite" => "Strict",
+        ],
+    );
+    return $login["token"];
+}
+
+/**
+ * Authenticate the user with the backend. If it rejects the auth message
+ * (e.g. it expired, or the user revoked their sessions), they're signed out.
+ * Throws if the backend can't be reached.
+ * @return array The user object: { id: string; balance: number, logged_in: boolean, token: string, serverSeedHash: string, clientSeed: string, rejected_message: string }
  */
 function authenticate()
 {
@@ -105,26 +210,70 @@ function authenticate()
     $user_id = "";
     $balance = 0.0;
     $serverSeedHash = "";
+    $clientSeed = "";
     $is_logged_in = false;
+    $token = "";
+    $rejected_message = "";
 
     if ($message !== "" && $signature !== "") {
-        $user = call_backend([
-            "action" => "user_get",
-            "message" => $message,
-            "signature" => $signature,
-        ]);
-        $user_id = $user["id"];
-        $balance = $user["balanceCents"] / 100.0;
-        $serverSeedHash = $user["serverSeedHash"];
-        $is_logged_in = true;
+        try {
+            $token = session_token($message, $signature);
+            try {
+                $user = call_backend([
+                    "action" => "user_get",
+                    "token" => $token,
+                ]);
+            } catch (BackendException $e) {
+                if (!$e->is_auth_error()) {
+                    throw $e;
+                }
+                // the session ended early, e.g. the backend's key
+                // changed, so try to log in again
+                $token = session_token($message, $signature, false);
+                $user = call_backend([
+                    "action" => "user_get",
+                    "token" => $token,
+                ]);
+            }
+            $user_id = $user["id"];
+            $balance = $user["balanceCents"] / 100.0;
+            $serverSeedHash = $user["serverSeedHash"];
+            $clientSeed = $user["clientSeed"];
+            $is_logged_in = true;
+        } catch (BackendException $e) {
+            if (!$e->is_auth_error()) {
+                throw $e;
+            }
+            // sign out, so the user can sign a new message
+            clear_cookie("Message");
+            clear_cookie("Signature");
+            clear_cookie("Token");
+            $token = "";
+            $rejected_message = $message;
+        }
+    } elseif (isset($_COOKIE["Token"]) && is_string($_COOKIE["Token"])) {
+        // the user logged out, so end their session too
+        $cookie = explode(":", $_COOKIE["Token"], 3);
+        if (count($cookie) === 3) {
+            try {
+                call_backend([
+                    "action" => "logout",
+                    "token" => $cookie[2],
+                ]);
+            } catch (Exception $e) {
+                // it'll expire soon anyway
+            }
+        }
+        clear_cookie("Token");
     }
 
     return [
         "id" => $user_id,
         "balance" => $balance,
         "logged_in" => $is_logged_in,
-        "message" => $message,
-        "signature" => $signature,
+        "token" => $token,
         "serverSeedHash" => $serverSeedHash,
+        "clientSeed" => $clientSeed,
+        "rejected_message" => $rejected_message,
     ];
 }
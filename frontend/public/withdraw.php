@@ -1,7 +1,11 @@
 <?php
 require_once __DIR__ . "/util.php";
 
-$user = authenticate();
+try {
+    $user = authenticate();
+} catch (Exception $e) {
+    unavailable($e);
+}
 if (!$user["logged_in"]) {
     header("Location: /");
     exit();
@@ -23,11 +27,13 @@ if ($_SERVER["REQUEST_METHOD"] === "POST") {
                 try {
                     $result = call_backend([
                         "action" => "withdraw",
-                        "message" => $user["message"],
-                        "signature" => $user["signature"],
+                        "token" => $user["token"],
                         "amountCents" => intval($amount * 100),
                     ]);
-                    $success_message = "Withdrawal created successfully!";
+                    $success_message =
+                        "Withdrawal created successfully! Claim it before " .
+                        date("Y-m-d H:i", $result["expiresAt"]) .
+                        ", or it will be refunded to your balance.";
                     $withdraw_url = $result["url"];
                     // Update local balance
                     $user["balance"] -= $amount;
@@ -38,14 +44,42 @@ if ($_SERVER["REQUEST_METHOD"] === "POST") {
         } else {
             $error_message = "Please enter a valid amount";
         }
+    } elseif (isset($_POST["check_status"])) {
+        $withdraw_id = $_POST["withdraw_id"] ?? "";
+        if ($withdraw_id) {
+            try {
+                $updated_withdrawal = call_backend([
+                    "action" => "withdraw_status",
+                    "token" => $user["token"],
+                    "withdrawId" => $withdraw_id,
+                ]);
+                if ($updated_withdrawal["completed"]) {
+                    $success_message =
+                        "Withdrawal " .
+                        substr($withdraw_id, 0, 8) .
+                        "... has been claimed!";
+                } elseif ($updated_withdrawal["expired"]) {
+                    $error_message =
+                        "Withdrawal " .
+                        substr($withdraw_id, 0, 8) .
+                        "... expired and was refunded to your balance";
+                } else {
+                    $error_message =
+                        "Withdrawal " .
+                        substr($withdraw_id, 0, 8) .
+                        "... has not been claimed yet";
+                }
+            } catch (Exception $e) {
+                $error_message = $e->getMessage();
+            }
+        }
     }
 }
 
 // Fetch recent withdrawals
 $recent_withdrawals = call_backend([
     "action" => "withdraw_list",
-    "message" => $user["message"],
-    "signature" => $user["signature"],
+    "token" => $user["token"],
     "count" => 10,
     "skip" => 0,
 ]);
@@ -167,7 +201,9 @@ $recent_withdrawals = call_backend([
                                     <tr class="text-left text-gray-400 text-sm border-b border-gray-700">
                                         <th class="pb-2">ID</th>
                                         <th class="pb-2">Amount</th>
+                                        <th class="pb-2">Status</th>
                                         <th class="pb-2">Date</th>
+                                        <th class="pb-2">Action</th>
                                     </tr>
                                 </thead>
                                 <tbody class="text-sm">
@@ -200,6 +236,19 @@ $recent_withdrawals = call_backend([
                                                     2
                                                 ) ?>
                                             </td>
+                                            <td class="py-3 pr-4">
+                                                <?php if (
+                                                    $withdrawal["completed"]
+                                                ): ?>
+                                                    <span class="text-green-400">Claimed</span>
+                                                <?php elseif (
+                                                    $withdrawal["expired"]
+                                                ): ?>
+                                                    <span class="text-gray-400">Expired (refunded)</span>
+                                                <?php else: ?>
+                                                    <span class="text-yellow-400">Unclaimed</span>
+                                                <?php endif; ?>
+                                            </td>
                                             <td class="py-3 pr-4">
                                                 <?php
                                                 $date = new DateTime();
@@ -209,6 +258,28 @@ $recent_withdrawals = call_backend([
                                                 echo $date->format("Y-m-d H:i");
                                                 ?>
                                             </td>
+                                            <td class="py-3">
+                                                <?php if (
+                                                    !$withdrawal["completed"] &&
+                                                    !$withdrawal["expired"]
+                                                ): ?>
+                                                    <form method="POST" class="inline">
+                                                        <input type="hidden" name="withdraw_id" value="<?= htmlspecialchars(
+                                                            $withdrawal["id"]
+                                                        ) ?>">
+                                                        <button
+                                                            type="submit"
+                                                            name="check_status"
+                                                            value="1"
+                                                            class="px-3 py-1 bg-gray-700 text-gray-300 rounded text-xs hover:bg-gray-600 transition-colors"
+                                                        >
+                                                            Check
+                                                        </button>
+                                                    </form>
+                                                <?php else: ?>
+                                                    <span class="text-gray-500 text-xs">-</span>
+                                                <?php endif; ?>
+                                            </td>
                                         </tr>
                                     <?php endforeach; ?>
                                 </tbody>